@@ -0,0 +1,109 @@
+package adapters
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/Magnetic/pool/typed"
+)
+
+// PoolGroup keeps a separate pool of clients for every host so that a slow
+// host cannot starve requests to the others. The pools are created on first
+// use of their host, each with its own limits, while the total number of
+// clients open across all hosts can be capped as well.
+type PoolGroup struct {
+	pools *typed.KeyedPool[string, HttpClient]
+}
+
+// NewPoolGroup returns a group creating the pool of every host with opts.
+// Up to maxTotal clients, idle or borrowed, may be open across all hosts,
+// zero means no cap, see typed.KeyedOptions.MaxTotal.
+func NewPoolGroup(factory func() (HttpClient, error), opts typed.Options[HttpClient], maxTotal int) (*PoolGroup, error) {
+	return NewPoolGroupWithOptions(factory, typed.KeyedOptions[HttpClient]{Options: opts, MaxTotal: maxTotal})
+}
+
+// NewPoolGroupWithOptions is like NewPoolGroup but also allows closing the
+// pools of hosts which are no longer requested, see typed.KeyedOptions.
+func NewPoolGroupWithOptions(factory func() (HttpClient, error), opts typed.KeyedOptions[HttpClient]) (*PoolGroup, error) {
+	var keyedFactory typed.KeyedFactory[string, HttpClient]
+	if factory != nil {
+		keyedFactory = func(string) (HttpClient, error) { return factory() }
+	}
+	pools, err := typed.NewKeyedPool(keyedFactory, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolGroup{pools: pools}, nil
+}
+
+// hostKey returns the key of the pool serving requests to u.
+func hostKey(u *url.URL) string {
+	return u.Scheme + "://" + strings.ToLower(u.Host)
+}
+
+// SetHostOptions overrides the options of the pool for key, as in
+// "https://example.com". It fails while the pool is in use.
+func (g *PoolGroup) SetHostOptions(key string, opts typed.Options[HttpClient]) error {
+	return g.pools.SetKeyOptions(key, opts)
+}
+
+// Get waits for a client from the pool for key until ctx is done, including
+// the wait for the total number of borrowed clients to drop below the cap.
+func (g *PoolGroup) Get(ctx context.Context, key string) (*typed.Holder[HttpClient], error) {
+	return g.pools.GetContext(ctx, key)
+}
+
+// Put puts a client back to the pool for key it was borrowed from.
+func (g *PoolGroup) Put(key string, conn *typed.Holder[HttpClient]) error {
+	return g.pools.Put(key, conn)
+}
+
+// Discard closes a broken client borrowed for key instead of putting it
+// back, a new one is created in its place.
+func (g *PoolGroup) Discard(key string, conn *typed.Holder[HttpClient], reason error) error {
+	return g.pools.Discard(key, conn, reason)
+}
+
+// Len returns the number of idle clients across all hosts.
+func (g *PoolGroup) Len() int {
+	return g.pools.Len()
+}
+
+// Stats returns the statistics of the pools of all hosts added up. Timeouts
+// also counts the waits for the total cap given up.
+func (g *PoolGroup) Stats() typed.Stats {
+	return g.pools.Stats()
+}
+
+// HostStats returns the statistics of the pool for key, if there is one.
+func (g *PoolGroup) HostStats(key string) (typed.Stats, bool) {
+	return g.pools.KeyStats(key)
+}
+
+// DebugDump writes the clients currently borrowed from the pool of every
+// host to w, along with the stack traces of their borrowers if the pools
+// detect leaks, see typed.Options.LeakThreshold.
+func (g *PoolGroup) DebugDump(w io.Writer) error {
+	return g.pools.DebugDump(w)
+}
+
+// Resize changes the number of clients pooled for every host, except those
+// with options of their own, see SetHostOptions.
+func (g *PoolGroup) Resize(poolSize int) error {
+	return g.pools.Resize(poolSize)
+}
+
+// Close closes the pools of all hosts. Clients borrowed at that point are
+// closed once put back.
+func (g *PoolGroup) Close() error {
+	return g.pools.Close()
+}
+
+// Shutdown closes the pools of all hosts and waits until the borrowed
+// clients are put back. If ctx is done first, it returns an error wrapping
+// ctx.Err() along with the clients still borrowed.
+func (g *PoolGroup) Shutdown(ctx context.Context) ([]*typed.Holder[HttpClient], error) {
+	return g.pools.Shutdown(ctx)
+}
@@ -0,0 +1,185 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Magnetic/pool/typed"
+)
+
+func TestHostKey(t *testing.T) {
+	u, _ := url.Parse("HTTPS://Example.com:8443/path?q=1")
+	assert.Equal(t, "https://example.com:8443", hostKey(u))
+}
+
+func TestPooledHttpClient_PerHostPools(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	defer close(release)
+
+	go pooledClient.Get(slow.URL)
+	time.Sleep(normalCallSleepDuration) // let the slow request take its host's only client
+
+	// the slow host's pool is exhausted
+	ctx, cancel := context.WithTimeout(context.Background(), normalCallSleepDuration)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, slow.URL, nil)
+	_, err = pooledClient.Do(req.WithContext(ctx))
+	assert.True(t, errors.Is(err, typed.ErrTimedOut), "expected to time out, got %v", err)
+
+	// while the other host is served by its own pool
+	resp, err := pooledClient.Get(fast.URL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	slowURL, _ := url.Parse(slow.URL)
+	stats, ok := pooledClient.pools.HostStats(hostKey(slowURL))
+	assert.True(t, ok)
+	assert.Equal(t, 1, stats.InUse)
+	assert.Equal(t, 1, pooledClient.Stats().InUse)
+	assert.Equal(t, 2, pooledClient.Stats().MaxOpen)
+}
+
+func TestPoolGroup_MaxTotal(t *testing.T) {
+	group, err := NewPoolGroup(httpClientFactory, typed.Options[HttpClient]{MaxCap: 2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+
+	conn1, err := group.Get(context.Background(), "http://a")
+	assert.NoError(t, err)
+	conn2, err := group.Get(context.Background(), "http://b")
+	assert.NoError(t, err)
+
+	// both hosts have room left but the total is capped
+	ctx, cancel := context.WithTimeout(context.Background(), normalCallSleepDuration)
+	defer cancel()
+	_, err = group.Get(ctx, "http://a")
+	assert.True(t, errors.Is(err, typed.ErrTimedOut), "expected to time out, got %v", err)
+	assert.Equal(t, int64(1), group.Stats().Timeouts)
+
+	assert.Equal(t, typed.ErrForeignConnection, group.Put("http://c", conn1))
+	assert.NoError(t, group.Put("http://a", conn1))
+	conn3, err := group.Get(context.Background(), "http://b")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, group.Stats().InUse)
+
+	group.Put("http://b", conn2)
+	group.Put("http://b", conn3)
+	assert.Equal(t, 0, group.Stats().InUse)
+
+	// idle clients count against the cap as well
+	conn4, err := group.Get(context.Background(), "http://c")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, group.Stats().Open)
+	group.Put("http://c", conn4)
+}
+
+func TestPoolGroup_MaxTotal_SaturatedHost(t *testing.T) {
+	group, err := NewPoolGroup(httpClientFactory, typed.Options[HttpClient]{MaxCap: 1}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+
+	slow, err := group.Get(context.Background(), "http://slow")
+	assert.NoError(t, err)
+	// another caller waits for the only client of the slow host
+	waiting, cancelWaiting := context.WithCancel(context.Background())
+	defer cancelWaiting()
+	go group.Get(waiting, "http://slow")
+	time.Sleep(normalCallSleepDuration)
+
+	// which doesn't use up the total cap for the healthy host
+	ctx, cancel := context.WithTimeout(context.Background(), normalCallSleepDuration)
+	defer cancel()
+	healthy, err := group.Get(ctx, "http://healthy")
+	if assert.NoError(t, err) {
+		group.Put("http://healthy", healthy)
+	}
+	group.Put("http://slow", slow)
+}
+
+func TestPoolGroup_SetHostOptions(t *testing.T) {
+	group, err := NewPoolGroup(httpClientFactory, typed.Options[HttpClient]{MaxCap: 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+
+	assert.NoError(t, group.SetHostOptions("http://a", typed.Options[HttpClient]{MaxCap: 5}))
+	conn, err := group.Get(context.Background(), "http://a")
+	assert.NoError(t, err)
+	group.Put("http://a", conn)
+	stats, _ := group.HostStats("http://a")
+	assert.Equal(t, 5, stats.MaxOpen)
+
+	assert.Error(t, group.SetHostOptions("http://a", typed.Options[HttpClient]{MaxCap: 1}))
+
+	group.Close()
+	_, err = group.Get(context.Background(), "http://a")
+	assert.Equal(t, typed.ErrClosed, err)
+}
+
+func TestPoolGroup_Resize_HostOptions(t *testing.T) {
+	group, err := NewPoolGroup(httpClientFactory, typed.Options[HttpClient]{MaxCap: 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+
+	assert.NoError(t, group.SetHostOptions("http://a", typed.Options[HttpClient]{MaxCap: 5}))
+	for _, host := range []string{"http://a", "http://b"} {
+		conn, err := group.Get(context.Background(), host)
+		assert.NoError(t, err)
+		group.Put(host, conn)
+	}
+
+	// the host with options of its own keeps its limits
+	assert.NoError(t, group.Resize(1))
+	stats, _ := group.HostStats("http://a")
+	assert.Equal(t, 5, stats.MaxOpen)
+	stats, _ = group.HostStats("http://b")
+	assert.Equal(t, 1, stats.MaxOpen)
+}
+
+func TestPooledHttpClient_Resize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(3, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+
+	if _, err := pooledClient.Get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, pooledClient.Stats().Open)
+
+	assert.NoError(t, pooledClient.Resize(1))
+	assert.Equal(t, 1, pooledClient.Stats().MaxOpen)
+	assert.Equal(t, 1, pooledClient.Stats().Open)
+	assert.Error(t, pooledClient.Resize(0))
+}
@@ -2,13 +2,16 @@ package adapters
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/Magnetic/pool"
+	"github.com/Magnetic/pool/typed"
 )
 
 // HttpClient represents behavior of a client within net/http package
@@ -18,45 +21,174 @@ type HttpClient interface {
 	Post(url string, bodyType string, body io.Reader) (*http.Response, error)
 }
 
-// PooledHttpClient is an adaper for standard net/http client which delegates to a pool under the hood
+// PooledHttpClient is an adaper for standard net/http client which delegates to a pool under the hood.
+// Requests are sent with clients from the pool for their scheme and host.
 type PooledHttpClient struct {
 	http.Client
-	connPool         pool.Pool
-	timeout          time.Duration
+	pools   *PoolGroup
+	timeout time.Duration
+	// OutstandingConns is the number of pooled clients currently in use,
+	// accessed atomically.
+	//
+	// Deprecated: use Stats().InUse instead.
 	OutstandingConns int32
+
+	// StreamResponses makes responses stream their body instead of reading
+	// it entirely before they are returned. The pooled client is then held
+	// until the body is fully read or closed, so callers must close it.
+	StreamResponses bool
+	// StreamThreshold is the number of bytes buffered when streaming. A body
+	// which fits is still read entirely and the pooled client is returned
+	// right away.
+	StreamThreshold int64
+
+	// MaxResponseBytes is the maximum size of a response body. Larger bodies
+	// fail with ErrResponseTooLarge, either when the response is returned or,
+	// when streaming, once the body is read past the limit. Zero means no
+	// limit.
+	MaxResponseBytes int64
+
+	// RetryPolicy decides whether failed requests are retried, they are not
+	// if it is nil.
+	RetryPolicy RetryPolicy
+
+	// Breaker, if set, fails requests fast with typed.ErrCircuitOpen while
+	// requests keep failing with connection errors or 5xx responses.
+	Breaker *typed.CircuitBreaker
 }
 
+// ErrResponseTooLarge is the error resulting if a response body is larger
+// than PooledHttpClient.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("response body exceeds the maximum size")
+
 // HttpResponseBody is an adapter for body present within http.Respose
 // it holds all of the data from the original body and presents the same
 // io.Reader interface to the outside world so that this body can be used
-// in the same way as the original
+// in the same way as the original.
+// When streaming, it reads through to the original body instead and puts
+// the pooled client back once the body is drained or closed.
 type HttpResponseBody struct {
+	// io.ReadCloser is the original body while streaming
 	io.ReadCloser
 	body io.Reader
-	err  error
+	// err is returned once all the data read before it occurred is consumed
+	err error
+	// size is the number of bytes buffered, -1 while streaming
+	size int64
+
+	// release puts the pooled client back while streaming, given the error
+	// reading the body failed with if any
+	release func(error)
+	once    sync.Once
 }
 
-// read the entire content out so that we can close the body
-func newBodyWrapper(del io.ReadCloser) *HttpResponseBody {
-	response := &HttpResponseBody{}
-	data, err := ioutil.ReadAll(del)
+// read the entire content out so that we can close the body. It fails with
+// ErrResponseTooLarge if the content is larger than maxBytes, unless
+// maxBytes is zero.
+func newBodyWrapper(del io.ReadCloser, maxBytes int64) (*HttpResponseBody, error) {
+	data, err := ioutil.ReadAll(limitBody(del, maxBytes))
 	del.Close()
-	response.body = bytes.NewReader(data)
-	response.err = err
-	return response
+	if err == ErrResponseTooLarge {
+		return nil, err
+	}
+	return &HttpResponseBody{body: bytes.NewReader(data), err: err, size: int64(len(data))}, nil
 }
 
-func (w HttpResponseBody) Read(p []byte) (n int, err error) {
-	if w.err != nil {
-		return 0, w.err
-	} else {
-		return w.body.Read(p)
+// newStreamingBody buffers up to threshold bytes of del and only streams the
+// rest if the body is larger than that. release is called once the pooled
+// client is no longer needed, with the error reading del failed with if any.
+// It fails with ErrResponseTooLarge if the buffered content is already
+// larger than maxBytes, unless maxBytes is zero, while the streamed content
+// fails reading past maxBytes.
+func newStreamingBody(del io.ReadCloser, threshold, maxBytes int64, release func(error)) (*HttpResponseBody, error) {
+	limited := limitBody(del, maxBytes)
+	data, err := ioutil.ReadAll(io.LimitReader(limited, threshold+1))
+	if err != nil || int64(len(data)) <= threshold {
+		del.Close()
+		release(err)
+		if err == ErrResponseTooLarge {
+			return nil, err
+		}
+		return &HttpResponseBody{body: bytes.NewReader(data), err: err, size: int64(len(data))}, nil
 	}
 
+	return &HttpResponseBody{
+		ReadCloser: del,
+		body:       io.MultiReader(bytes.NewReader(data), limited),
+		size:       -1,
+		release:    release,
+	}, nil
 }
 
-func (w HttpResponseBody) Close() (err error) {
-	return nil
+// limitBody returns a reader failing with ErrResponseTooLarge once more than
+// maxBytes are read from r, or r itself if maxBytes is zero.
+func limitBody(r io.Reader, maxBytes int64) io.Reader {
+	if maxBytes <= 0 {
+		return r
+	}
+	return &maxBytesReader{r: r, n: maxBytes}
+}
+
+// maxBytesReader reads from r until n bytes are left, much like
+// http.MaxBytesReader does for request bodies.
+type maxBytesReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *maxBytesReader) Read(p []byte) (n int, err error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	// read one more byte than allowed to tell whether there are more
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err = l.r.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		l.err = err
+		return n, err
+	}
+
+	n = int(l.n)
+	l.n = 0
+	l.err = ErrResponseTooLarge
+	return n, l.err
+}
+
+func (w *HttpResponseBody) Read(p []byte) (n int, err error) {
+	n, err = w.body.Read(p)
+	if err == io.EOF && w.err != nil {
+		err = w.err
+	}
+	if err != nil && w.release != nil {
+		// drained or broken, either way the client is done with it
+		if err == io.EOF {
+			w.close(nil)
+		} else {
+			w.close(err)
+		}
+	}
+	return n, err
+}
+
+func (w *HttpResponseBody) Close() error {
+	return w.close(nil)
+}
+
+// close closes the original body while streaming and releases the pooled
+// client, given the error reading the body failed with if any.
+func (w *HttpResponseBody) close(readErr error) (err error) {
+	if w.release == nil {
+		return nil
+	}
+	w.once.Do(func() {
+		err = w.ReadCloser.Close()
+		w.release(readErr)
+	})
+	return err
 }
 
 func NewPooledHttpClientWithTimeout(poolSize int, factory func() (HttpClient, error), timeout time.Duration) (*PooledHttpClient, error) {
@@ -69,26 +201,45 @@ func NewPooledHttpClientWithTimeout(poolSize int, factory func() (HttpClient, er
 	}
 }
 
+// NewPooledHttpClient returns a client keeping a pool of poolSize clients
+// for every host it sends requests to.
 func NewPooledHttpClient(poolSize int, factory func() (HttpClient, error)) (*PooledHttpClient, error) {
-	factoryWrapper := func() (pool.GenericConn, error) {
-		inst, err := factory()
-		if err == nil && inst != nil {
-			return inst.(pool.GenericConn), err
-		} else {
-			return nil, err
-		}
+	pools, err := NewPoolGroup(factory, typed.Options[HttpClient]{
+		InitialCap: poolSize,
+		MaxCap:     poolSize,
+		CloseFunc:  closeIdleConnections,
+	}, 0)
+	if err != nil {
+		return nil, err
 	}
-	pool, err := pool.NewChannelPool(poolSize, factoryWrapper)
 
-	return &PooledHttpClient{connPool: pool}, err
+	return NewPooledHttpClientWithGroup(pools), nil
+}
+
+// NewPooledHttpClientWithGroup returns a client sending requests with the
+// clients of pools, e.g. to cap the clients in use across all hosts.
+func NewPooledHttpClientWithGroup(pools *PoolGroup) *PooledHttpClient {
+	return &PooledHttpClient{pools: pools}
 }
 
-func (c *PooledHttpClient) getConn() (connHolder *pool.ConnectionHolder, err error) {
+// closeIdleConnections releases the idle connections kept by the transport
+// of a client which is removed from the pool
+func closeIdleConnections(conn HttpClient) error {
+	if closer, ok := conn.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	return nil
+}
+
+// getConn waits for a client pooled for key until ctx is done or, if set,
+// the client's timeout elapses, whichever comes first
+func (c *PooledHttpClient) getConn(ctx context.Context, key string) (connHolder *typed.Holder[HttpClient], err error) {
 	if c.timeout > 0 {
-		connHolder, err = c.connPool.GetWithTimeout(c.timeout)
-	} else {
-		connHolder, err = c.connPool.Get()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
 	}
+	connHolder, err = c.pools.Get(ctx, key)
 
 	if err != nil {
 		return connHolder, err
@@ -98,57 +249,192 @@ func (c *PooledHttpClient) getConn() (connHolder *pool.ConnectionHolder, err err
 	}
 }
 
-func (c *PooledHttpClient) putConn(conn *pool.ConnectionHolder) {
-	if conn == nil || !conn.InUse {
+func (c *PooledHttpClient) putConn(key string, conn *typed.Holder[HttpClient]) {
+	if conn == nil || !conn.InUse() {
 		return
 	}
-	c.connPool.Put(conn)
+	c.pools.Put(key, conn)
 	atomic.AddInt32(&c.OutstandingConns, -1)
 }
 
-func (c *PooledHttpClient) Get(url string) (resp *http.Response, err error) {
-	connHolder, err := c.getConn()
-	defer c.putConn(connHolder)
-
-	if err != nil {
-		return nil, err
+// releaseConn puts a client back once it is done with a request, or
+// discards it if the request or the reading of its response failed with a
+// connection error.
+func (c *PooledHttpClient) releaseConn(req *http.Request, key string, conn *typed.Holder[HttpClient], err error) {
+	if err != nil && isConnectionError(req.Context(), err) {
+		c.discardConn(key, conn, err)
+	} else {
+		c.putConn(key, conn)
 	}
-	resp, err = connHolder.Conn.(*http.Client).Get(url)
-	if err != nil {
+}
+
+// discardConn replaces a client whose request failed with a connection
+// error, closing the connections it keeps to the host.
+func (c *PooledHttpClient) discardConn(key string, conn *typed.Holder[HttpClient], reason error) {
+	if conn == nil || !conn.InUse() {
 		return
 	}
-	resp.Body = newBodyWrapper(resp.Body)
-	return
+	c.pools.Discard(key, conn, reason)
+	atomic.AddInt32(&c.OutstandingConns, -1)
 }
 
-func (c *PooledHttpClient) Post(url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
-	connHolder, err := c.getConn()
-	defer c.putConn(connHolder)
+func (c *PooledHttpClient) Get(url string) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err = connHolder.Conn.(*http.Client).Post(url, bodyType, body)
+	return c.Do(req)
+}
+
+func (c *PooledHttpClient) Post(url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
 	if err != nil {
-		return
+		return nil, err
 	}
-	resp.Body = newBodyWrapper(resp.Body)
-	return
+	req.Header.Set("Content-Type", bodyType)
+	return c.Do(req)
 }
 
+// Do sends the request using a pooled client. The request's context also
+// governs the wait for a client to become available in the pool.
+// If a RetryPolicy is set, failed attempts are retried as it decides, each
+// with a possibly different pooled client. Request bodies are rewound
+// through req.GetBody, requests with a body which cannot be rewound are not
+// retried.
 func (c *PooledHttpClient) Do(req *http.Request) (resp *http.Response, err error) {
-	connHolder, err := c.getConn()
-	defer c.putConn(connHolder)
+	for attempt := 1; ; attempt++ {
+		resp, err = c.send(req)
+		if c.RetryPolicy == nil {
+			return resp, err
+		}
+		delay, retry := c.RetryPolicy.Retry(req, resp, err, attempt)
+		if !retry {
+			return resp, err
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			retryReq := *req
+			retryReq.Body = body
+			req = &retryReq
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// send makes a single attempt with a pooled client and wraps the response
+// body so that the client can be put back to the pool
+func (c *PooledHttpClient) send(req *http.Request) (*http.Response, error) {
+	// consult the breaker before waiting for a client, so that callers fail
+	// fast while the clients are held by requests to a hung backend. A trial
+	// which gets no client isn't reported, the breaker lets another one
+	// through after its cooldown.
+	if c.Breaker != nil {
+		if err := c.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+	key := hostKey(req.URL)
+	connHolder, err := c.getConn(req.Context(), key)
 	if err != nil {
 		return nil, err
 	}
-	resp, err = connHolder.Conn.(*http.Client).Do(req)
+	resp, err := connHolder.Conn.Do(req)
+	c.report(req, resp, err)
+	if err != nil {
+		c.releaseConn(req, key, connHolder, err)
+		return resp, err
+	}
+
+	var body *HttpResponseBody
+	if c.StreamResponses {
+		body, err = newStreamingBody(resp.Body, c.StreamThreshold, c.MaxResponseBytes, func(err error) {
+			c.releaseConn(req, key, connHolder, err)
+		})
+	} else {
+		body, err = newBodyWrapper(resp.Body, c.MaxResponseBytes)
+		readErr := err
+		if body != nil {
+			readErr = body.err
+		}
+		c.releaseConn(req, key, connHolder, readErr)
+	}
 	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = body
+	if body.size >= 0 {
+		resp.ContentLength = body.size
+	}
+	return resp, nil
+}
+
+// report feeds the outcome of a request to the circuit breaker, if any.
+// Cancelled requests don't tell anything about the backend and are ignored.
+func (c *PooledHttpClient) report(req *http.Request, resp *http.Response, err error) {
+	if c.Breaker == nil {
 		return
 	}
-	resp.Body = newBodyWrapper(resp.Body)
-	return
+	switch {
+	case err != nil && isConnectionError(req.Context(), err):
+		c.Breaker.Failure()
+	case err != nil:
+	case resp.StatusCode >= http.StatusInternalServerError:
+		c.Breaker.Failure()
+	default:
+		c.Breaker.Success()
+	}
+}
+
+// Stats returns a snapshot of the statistics of the underlying pools added
+// up across all hosts.
+func (c *PooledHttpClient) Stats() typed.Stats {
+	return c.pools.Stats()
+}
+
+// DebugDump writes the clients currently borrowed by requests in flight or
+// bodies not closed yet to w, see PoolGroup.DebugDump.
+func (c *PooledHttpClient) DebugDump(w io.Writer) error {
+	return c.pools.DebugDump(w)
+}
+
+// Resize changes the number of clients pooled for every host, e.g. as an
+// autoscaler sees fit. Clients in excess are closed once they are idle.
+// Hosts with options of their own, see PoolGroup.SetHostOptions, keep their
+// limits.
+func (c *PooledHttpClient) Resize(poolSize int) error {
+	return c.pools.Resize(poolSize)
+}
+
+// Cleanup closes the underlying pools along with the idle connections of
+// every pooled client. It doesn't wait for the requests in flight, the
+// clients they use, including those of streamed response bodies not closed
+// yet, are closed once they are put back. Use Shutdown to wait for them.
+func (c *PooledHttpClient) Cleanup() error {
+	return c.pools.Close()
 }
 
-func (c *PooledHttpClient) Cleanup() {
-	c.connPool.Close()
+// Shutdown is like Cleanup but also waits for the requests in flight to
+// complete, including the reading of streamed response bodies. It stops
+// waiting once ctx is done, returning an error wrapping ctx.Err() along
+// with the clients still borrowed by them.
+func (c *PooledHttpClient) Shutdown(ctx context.Context) ([]*typed.Holder[HttpClient], error) {
+	return c.pools.Shutdown(ctx)
 }
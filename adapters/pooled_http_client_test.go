@@ -2,20 +2,28 @@ package adapters
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"io/ioutil"
 	"log"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/Magnetic/pool"
+	"github.com/Magnetic/pool/typed"
 )
 
 const testUrl = "http://localhost:7777/echo"
@@ -154,71 +162,83 @@ func TestConnPost(t *testing.T) {
 	defer resp.Body.Close()
 
 	if msg != string(respMsg) {
-		t.Errorf("Expected response %s but got %s ", msg, resp)
+		t.Errorf("Expected response %s but got %s ", msg, respMsg)
 	}
 }
 
 func TestPooledHttpClient_Post(t *testing.T) {
-	p, _ := pool.NewChannelPool(maxPoolSize, factory)
-
-	pooledClient := PooledHttpClient{connPool: p}
+	pooledClient, _ := NewPooledHttpClient(maxPoolSize, httpClientFactory)
 
 	respChannel := make(chan http.Response, maxPoolSize)
 
-	doExhaustPool(&pooledClient, doPost, maxPoolSize, respChannel)
+	doExhaustPool(pooledClient, doPost, maxPoolSize, respChannel)
 	respReceived, timedOut := getFastResponses(maxPoolSize, respChannel)
 	assert.True(t, timedOut, "expected to timeout on last slow request")
 	assert.Equal(t, maxPoolSize-1, respReceived)
-	assert.Equal(t, maxPoolSize-1, pooledClient.connPool.Len()) // slow connection is still busy
-	time.Sleep(longerCallSleepDuration)                         // wait for slow request to return
+	assert.Equal(t, maxPoolSize-1, pooledClient.pools.Len()) // slow connection is still busy
+	time.Sleep(longerCallSleepDuration)                      // wait for slow request to return
 	assert.Equal(t, 1, len(respChannel))
-	assert.Equal(t, maxPoolSize, pooledClient.connPool.Len()) // all conns back in the pool
+	assert.Equal(t, maxPoolSize, pooledClient.pools.Len()) // all conns back in the pool
 }
 
 func TestPooledHttpClient_Do(t *testing.T) {
-	p, _ := pool.NewChannelPool(maxPoolSize, factory)
-
-	pooledClient := PooledHttpClient{connPool: p}
+	pooledClient, _ := NewPooledHttpClient(maxPoolSize, httpClientFactory)
 
 	respChannel := make(chan http.Response, maxPoolSize)
 
-	doExhaustPool(&pooledClient, do, maxPoolSize, respChannel)
+	doExhaustPool(pooledClient, do, maxPoolSize, respChannel)
 	respReceived, timedOut := getFastResponses(maxPoolSize, respChannel)
 	assert.True(t, timedOut, "expected to timeout on last, slow request")
 	assert.Equal(t, maxPoolSize-1, respReceived)
-	assert.Equal(t, maxPoolSize-1, pooledClient.connPool.Len()) // slow connection is still busy
-	time.Sleep(longerCallSleepDuration)                         // wait for slow request to return
+	assert.Equal(t, maxPoolSize-1, pooledClient.pools.Len()) // slow connection is still busy
+	time.Sleep(longerCallSleepDuration)                      // wait for slow request to return
 	assert.Equal(t, 1, len(respChannel))
-	assert.Equal(t, maxPoolSize, pooledClient.connPool.Len()) // all conns back in the pool
+	assert.Equal(t, maxPoolSize, pooledClient.pools.Len()) // all conns back in the pool
+}
+
+func TestPooledHttpClient_DoContextCancelled(t *testing.T) {
+	pooledClient, _ := NewPooledHttpClient(1, httpClientFactory)
+
+	respChannel := make(chan http.Response, 1)
+	go do(pooledClient, longerCallSleepDuration, "hello", respChannel)
+	time.Sleep(normalCallSleepDuration / 2) // let the slow request take the only client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest("POST", testUrl, bytes.NewReader([]byte("hello")))
+	_, err := pooledClient.Do(req.WithContext(ctx))
+	assert.True(t, errors.Is(err, context.Canceled), "expected cancelled wait, got %v", err)
+
+	<-respChannel
+	assert.Equal(t, 1, pooledClient.pools.Len())
 }
 
 // TestPooledHttpClient_Swarm tests
 func TestPooledHttpClient_Swarm(t *testing.T) {
 	StartHTTPServer()
 
-	pool, _ := pool.NewChannelPool(2, factory)
-	pooledClient := PooledHttpClient{connPool: pool}
+	pooledClient, _ := NewPooledHttpClient(2, httpClientFactory)
 
 	var wg sync.WaitGroup
-	responses := 0
+	var responses int32
 	for cnt := 10; cnt > 0; cnt-- {
+		wg.Add(1)
 		go func() {
-			wg.Add(1)
 			respChannel := make(chan http.Response, 1)
-			doPost(&pooledClient, longerCallSleepDuration, "hello", respChannel)
+			doPost(pooledClient, longerCallSleepDuration, "hello", respChannel)
+			atomic.AddInt32(&responses, 1)
 			wg.Done()
-			responses += 1
 		}()
 	}
 
 	time.Sleep(normalCallSleepDuration)
 	// verify that two connections are in use
-	assert.Equal(t, int32(2), pooledClient.OutstandingConns)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&pooledClient.OutstandingConns))
 	// verify no responses yet
-	assert.Equal(t, 0, responses)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&responses))
 	wg.Wait() // after this all responses should come in
-	assert.Equal(t, 10, responses)
-	assert.Equal(t, 0, int(pooledClient.OutstandingConns))
+	assert.Equal(t, int32(10), responses)
+	assert.Equal(t, 0, int(atomic.LoadInt32(&pooledClient.OutstandingConns)))
 
 }
 
@@ -226,30 +246,30 @@ func TestPooledHttpClient_Swarm(t *testing.T) {
 func TestPooledHttpClient_SwarmWithTimeout(t *testing.T) {
 	StartHTTPServer()
 
-	pool, _ := pool.NewChannelPool(2, factory)
-	pooledClient := PooledHttpClient{connPool: pool}
+	pooledClient, _ := NewPooledHttpClient(2, httpClientFactory)
 	pooledClient.timeout = normalCallSleepDuration / 2
 
 	var wg sync.WaitGroup
-	responses := 0
+	var responses int32
 	for cnt := 10; cnt > 0; cnt-- {
+		wg.Add(1)
 		go func() {
-			wg.Add(1)
 			respChannel := make(chan http.Response, 1)
-			doPost(&pooledClient, longerCallSleepDuration, "hello", respChannel)
+			doPost(pooledClient, longerCallSleepDuration, "hello", respChannel)
+			atomic.AddInt32(&responses, int32(len(respChannel)))
 			wg.Done()
-			responses += len(respChannel)
 		}()
 	}
 
 	time.Sleep(normalCallSleepDuration)
 	// verify that 2 connections are in use
-	assert.Equal(t, int32(2), pooledClient.OutstandingConns)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&pooledClient.OutstandingConns))
 	// verify no responses yet
-	assert.Equal(t, 0, responses)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&responses))
 	wg.Wait() // after this only two responses should come in - the rest timeout
-	assert.Equal(t, 2, responses)
-	assert.Equal(t, 0, int(pooledClient.OutstandingConns))
+	assert.Equal(t, int32(2), responses)
+	assert.Equal(t, int64(8), pooledClient.Stats().Timeouts)
+	assert.Equal(t, 0, int(atomic.LoadInt32(&pooledClient.OutstandingConns)))
 
 }
 
@@ -265,6 +285,350 @@ func TestLargeStringRead(t *testing.T) {
 	assert.Equal(t, largeString, string(body))
 }
 
+func TestStreamResponses(t *testing.T) {
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.StreamResponses = true
+	pooledClient.StreamThreshold = 1024
+
+	largeString := generateRandomString(1024 * 1000)
+	resp, err := pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte(largeString)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pooled client is held while the body is streamed
+	assert.Equal(t, 1, pooledClient.Stats().InUse)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, largeString, string(body))
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+	assert.Nil(t, resp.Body.Close())
+	assert.Equal(t, 1, pooledClient.pools.Len())
+
+	// closing the body early puts the client back as well
+	resp, err = pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte(largeString)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, pooledClient.Stats().InUse)
+	resp.Body.Close()
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+}
+
+func TestPooledHttpClient_Shutdown(t *testing.T) {
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooledClient.StreamResponses = true
+
+	resp, err := pooledClient.Post(testUrl, "text/plain", strings.NewReader(generateRandomString(1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client streaming the body is still borrowed
+	ctx, cancel := context.WithTimeout(context.Background(), normalCallSleepDuration)
+	defer cancel()
+	leaked, err := pooledClient.Shutdown(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected to time out, got %v", err)
+	assert.Len(t, leaked, 1)
+	_, err = pooledClient.Get(testUrl)
+	assert.Equal(t, typed.ErrClosed, err)
+
+	resp.Body.Close()
+	assert.NoError(t, pooledClient.Cleanup())
+}
+
+func TestPooledHttpClient_CleanupDoesNotWait(t *testing.T) {
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooledClient.StreamResponses = true
+
+	resp, err := pooledClient.Post(testUrl, "text/plain", strings.NewReader(generateRandomString(1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client streaming the body is closed once the body is
+	done := make(chan error, 1)
+	go func() { done <- pooledClient.Cleanup() }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Cleanup waited for the streamed body")
+	}
+	assert.Equal(t, 1, pooledClient.Stats().Open)
+	resp.Body.Close()
+	assert.Equal(t, 0, pooledClient.Stats().Open)
+}
+
+func TestStreamResponses_BuffersSmallBodies(t *testing.T) {
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.StreamResponses = true
+	pooledClient.StreamThreshold = 1024
+
+	resp, err := pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body fits in the threshold so the client is back already
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestHttpResponseBody_PartialReadError(t *testing.T) {
+	errBroken := errors.New("connection reset")
+	del := ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errBroken)))
+
+	body, err := newBodyWrapper(del, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len("partial")), body.size)
+
+	// the data read before the error comes first, then the error, every time
+	data, err := ioutil.ReadAll(body)
+	assert.Equal(t, "partial", string(data))
+	assert.Equal(t, errBroken, err)
+	_, err = body.Read(make([]byte, 1))
+	assert.Equal(t, errBroken, err)
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.MaxResponseBytes = 1024
+
+	largeString := generateRandomString(1024 * 1000)
+	_, err = pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte(largeString)))
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Equal(t, 1, pooledClient.pools.Len())
+
+	// the buffered length is exposed even for chunked responses
+	resp, err := pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte(largeString[:1024])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1024), resp.ContentLength)
+}
+
+func TestMaxResponseBytes_Streaming(t *testing.T) {
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.StreamResponses = true
+	pooledClient.StreamThreshold = 1024
+	pooledClient.MaxResponseBytes = 64 * 1024
+
+	largeString := generateRandomString(1024 * 1000)
+	resp, err := pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte(largeString)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Equal(t, largeString[:64*1024], string(data))
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+
+	// a limit below the threshold fails right away
+	pooledClient.MaxResponseBytes = 512
+	_, err = pooledClient.Post(testUrl, "text/plain", bytes.NewReader([]byte(largeString)))
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+}
+
+func TestPooledHttpClient_Breaker(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(2, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.Breaker = typed.NewCircuitBreaker(0.5, time.Hour)
+	pooledClient.Breaker.MinRequests = 3
+
+	for i := 0; i < 3; i++ {
+		resp, err := pooledClient.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+	_, err = pooledClient.Get(srv.URL)
+	assert.Equal(t, typed.ErrCircuitOpen, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "no request should be sent while the breaker is open")
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+}
+
+func TestPooledHttpClient_Breaker_ExhaustedPool(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.Breaker = typed.NewCircuitBreaker(0.5, time.Hour)
+	pooledClient.Breaker.MinRequests = 1
+	pooledClient.Breaker.Failure()
+
+	// the only client is held by a hung request
+	srvURL, _ := url.Parse(srv.URL)
+	holder, err := pooledClient.pools.Get(context.Background(), hostKey(srvURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.pools.Put(hostKey(srvURL), holder)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	start := time.Now()
+	_, err = pooledClient.Do(req.WithContext(ctx))
+	assert.Equal(t, typed.ErrCircuitOpen, err)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "an open breaker should fail fast, took %v", time.Since(start))
+}
+
+func TestPooledHttpClient_Breaker_TrialWithoutClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	pooledClient.Breaker = typed.NewCircuitBreaker(0.5, 20*time.Millisecond)
+	pooledClient.Breaker.MinRequests = 1
+	pooledClient.Breaker.Failure()
+	time.Sleep(25 * time.Millisecond)
+
+	// the trial times out waiting for a client
+	srvURL, _ := url.Parse(srv.URL)
+	holder, err := pooledClient.pools.Get(context.Background(), hostKey(srvURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_, err = pooledClient.Do(req.WithContext(ctx))
+	assert.True(t, errors.Is(err, typed.ErrTimedOut), "expected to time out, got %v", err)
+	pooledClient.pools.Put(hostKey(srvURL), holder)
+	_, err = pooledClient.Get(srv.URL)
+	assert.Equal(t, typed.ErrCircuitOpen, err, "another trial should wait for the cooldown")
+
+	// the lost trial costs one cooldown
+	time.Sleep(25 * time.Millisecond)
+	resp, err := pooledClient.Get(srv.URL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, typed.BreakerClosed, pooledClient.Breaker.State())
+}
+
+func TestPooledHttpClient_DiscardsBrokenClients(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close() // requests fail with connection refused
+
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+
+	_, err = pooledClient.Get(srv.URL)
+	assert.Error(t, err)
+	stats := pooledClient.Stats()
+	assert.Equal(t, int64(1), stats.Discarded)
+	assert.Equal(t, 0, stats.InUse)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&pooledClient.OutstandingConns))
+
+	// a replacement client serves the next request
+	resp, err := pooledClient.Get(testUrl)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestPooledHttpClient_DiscardsClientsOnBrokenBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// promise more than is sent before the connection breaks
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("truncated"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+
+	for _, stream := range []bool{false, true} {
+		pooledClient.StreamResponses = stream
+		resp, err := pooledClient.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(resp.Body)
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "streaming: %v", stream)
+		resp.Body.Close()
+		assert.Equal(t, 0, pooledClient.Stats().InUse, "streaming: %v", stream)
+	}
+	assert.Equal(t, int64(2), pooledClient.Stats().Discarded)
+}
+
+func TestPooledHttpClient_KeepsClientsOnClientErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(1, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+
+	// too many redirects is an error of the client, not of its connections
+	_, err = pooledClient.Get(srv.URL)
+	assert.Error(t, err)
+	stats := pooledClient.Stats()
+	assert.Equal(t, int64(0), stats.Discarded)
+	assert.Equal(t, 1, stats.Idle)
+	assert.Equal(t, 0, stats.InUse)
+}
+
 // getFastResponses waits for normal responses to come to the channel,
 // but not for the slow outlier
 func getFastResponses(poolCap int, respChannel chan http.Response) (int, bool) {
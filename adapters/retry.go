@@ -0,0 +1,167 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Magnetic/pool/typed"
+)
+
+// RetryPolicy decides whether PooledHttpClient retries a request and how long
+// it waits before doing so.
+type RetryPolicy interface {
+	// Retry is called after every attempt, starting with attempt 1, with the
+	// response and error the attempt resulted in. It returns whether to make
+	// another attempt and the delay before it.
+	Retry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool)
+}
+
+// DefaultRetryStatusCodes are the response status codes BackoffRetryPolicy
+// retries unless configured otherwise.
+var DefaultRetryStatusCodes = []int{
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// BackoffRetryPolicy retries connection errors and responses with one of the
+// RetryStatusCodes, waiting exponentially longer between the attempts.
+type BackoffRetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the second attempt, it doubles for every
+	// attempt after that.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts. A Retry-After header asking
+	// for a longer delay stops the retries. Zero means no cap.
+	MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, by which delays are randomly
+	// shortened, see typed.Backoff.
+	Jitter float64
+	// RetryStatusCodes are the response status codes which are retried,
+	// DefaultRetryStatusCodes if nil.
+	RetryStatusCodes []int
+	// RetryNonIdempotent allows retrying requests with methods which are not
+	// idempotent, such as POST.
+	RetryNonIdempotent bool
+}
+
+// NewBackoffRetryPolicy returns a policy making up to maxAttempts attempts,
+// starting with a 100ms delay capped at 5s and with 20% jitter.
+func NewBackoffRetryPolicy(maxAttempts int) *BackoffRetryPolicy {
+	return &BackoffRetryPolicy{
+		MaxAttempts: maxAttempts,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// Retry implements RetryPolicy.
+func (p *BackoffRetryPolicy) Retry(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	if !p.RetryNonIdempotent && !isIdempotent(req.Method) {
+		return 0, false
+	}
+
+	if err != nil {
+		if !isConnectionError(req.Context(), err) {
+			return 0, false
+		}
+		return p.backoff(attempt), true
+	}
+	if !p.retryStatus(resp.StatusCode) {
+		return 0, false
+	}
+
+	delay := p.backoff(attempt)
+	if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		if p.MaxDelay > 0 && retryAfter > p.MaxDelay {
+			return 0, false
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+	return delay, true
+}
+
+// backoff returns the delay after attempt.
+func (p *BackoffRetryPolicy) backoff(attempt int) time.Duration {
+	return typed.Backoff(attempt, p.BaseDelay, p.MaxDelay, p.Jitter)
+}
+
+func (p *BackoffRetryPolicy) retryStatus(code int) bool {
+	codes := p.RetryStatusCodes
+	if codes == nil {
+		codes = DefaultRetryStatusCodes
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdempotent reports whether requests with method can safely be sent more
+// than once.
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConnectionError reports whether err, returned by a request with ctx,
+// comes from talking to the server, as opposed to waiting for a pooled
+// client, the request being cancelled or the client refusing to send it,
+// e.g. for its URL scheme or a redirect policy. Whether the caller cancelled
+// the request is told by ctx, since timeouts of the client itself, such as
+// http.Client.Timeout, wrap context.DeadlineExceeded as well.
+func isConnectionError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, typed.ErrTimedOut) || errors.Is(err, typed.ErrClosed) {
+		return false
+	}
+	// http.Client wraps all of its errors in a url.Error, which is a
+	// net.Error itself, so look at what it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
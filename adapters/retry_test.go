@@ -0,0 +1,162 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Magnetic/pool/typed"
+)
+
+func TestBackoffRetryPolicy_Retry(t *testing.T) {
+	policy := &BackoffRetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second}
+	get, _ := http.NewRequest(http.MethodGet, testUrl, nil)
+	post, _ := http.NewRequest(http.MethodPost, testUrl, nil)
+	connErr := &url.Error{Op: "Get", URL: testUrl, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	unavailable := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	notFound := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}}
+
+	delay, retry := policy.Retry(get, nil, connErr, 1)
+	assert.True(t, retry, "connection errors should be retried")
+	assert.Equal(t, 10*time.Millisecond, delay)
+
+	delay, retry = policy.Retry(get, unavailable, nil, 2)
+	assert.True(t, retry, "503 should be retried")
+	assert.Equal(t, 20*time.Millisecond, delay)
+
+	_, retry = policy.Retry(get, unavailable, nil, 3)
+	assert.False(t, retry, "attempts should be capped by MaxAttempts")
+
+	_, retry = policy.Retry(get, notFound, nil, 1)
+	assert.False(t, retry, "404 should not be retried")
+
+	_, retry = policy.Retry(get, nil, &url.Error{Op: "Get", URL: testUrl, Err: errors.New("stopped after 10 redirects")}, 1)
+	assert.False(t, retry, "errors of the client itself should not be retried")
+
+	_, retry = policy.Retry(get, nil, typed.ErrTimedOut, 1)
+	assert.False(t, retry, "waiting for a pooled client should not be retried")
+
+	_, retry = policy.Retry(post, unavailable, nil, 1)
+	assert.False(t, retry, "POST should not be retried by default")
+	policy.RetryNonIdempotent = true
+	_, retry = policy.Retry(post, unavailable, nil, 1)
+	assert.True(t, retry, "POST should be retried when allowed")
+
+	policy.RetryStatusCodes = []int{http.StatusNotFound}
+	_, retry = policy.Retry(get, notFound, nil, 1)
+	assert.True(t, retry, "configured status codes should be retried")
+}
+
+func TestIsConnectionError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	}))
+	client := &http.Client{}
+	ctx := context.Background()
+
+	_, err := client.Get("ftp://" + srv.Listener.Addr().String())
+	assert.False(t, isConnectionError(ctx, err), "unsupported scheme: %v", err)
+	_, err = client.Get(srv.URL)
+	assert.False(t, isConnectionError(ctx, err), "too many redirects: %v", err)
+
+	srv.Close()
+	_, err = client.Get(srv.URL)
+	assert.True(t, isConnectionError(ctx, err), "connection refused: %v", err)
+}
+
+func TestIsConnectionError_Timeouts(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	ctx := context.Background()
+
+	client := &http.Client{Timeout: 20 * time.Millisecond}
+	_, err := client.Get(srv.URL)
+	assert.True(t, isConnectionError(ctx, err), "client timeout: %v", err)
+
+	client = &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond}}
+	_, err = client.Get(srv.URL)
+	assert.True(t, isConnectionError(ctx, err), "response header timeout: %v", err)
+
+	// the caller's own deadline is not the server's fault
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	_, err = http.DefaultClient.Do(req)
+	assert.False(t, isConnectionError(ctx, err), "caller deadline: %v", err)
+}
+
+func TestBackoffRetryPolicy_RetryAfter(t *testing.T) {
+	policy := &BackoffRetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 5 * time.Second}
+	get, _ := http.NewRequest(http.MethodGet, testUrl, nil)
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+
+	resp.Header.Set("Retry-After", "2")
+	delay, retry := policy.Retry(get, resp, nil, 1)
+	assert.True(t, retry)
+	assert.Equal(t, 2*time.Second, delay)
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	_, retry = policy.Retry(get, resp, nil, 1)
+	assert.False(t, retry, "Retry-After beyond MaxDelay should stop the retries")
+}
+
+func TestPooledHttpClient_Retry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	pooledClient, err := NewPooledHttpClient(2, httpClientFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pooledClient.Cleanup()
+	policy := NewBackoffRetryPolicy(3)
+	policy.BaseDelay = time.Millisecond
+	pooledClient.RetryPolicy = policy
+
+	// PUT is idempotent and its body is rewound for every attempt
+	req, _ := http.NewRequest(http.MethodPut, srv.URL, bytes.NewReader([]byte("hello")))
+	resp, err := pooledClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, pooledClient.Stats().InUse)
+
+	// POST isn't retried
+	atomic.StoreInt32(&calls, 0)
+	resp, err = pooledClient.Post(srv.URL, "text/plain", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
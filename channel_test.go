@@ -1,14 +1,10 @@
 package pool
 
 import (
-	"math/rand"
-	"sync"
+	"errors"
+	"net"
 	"testing"
 	"time"
-	"strings"
-
-	"golang.org/x/net/context"
-
 )
 
 var (
@@ -19,253 +15,75 @@ var (
 	}
 )
 
-func TestNew(t *testing.T) {
-	_, err := newChannelPool()
-	if err != nil {
-		t.Errorf("New error: %s", err)
-	}
-}
-func TestPool_Get_Impl(t *testing.T) {
-	p, _ := newChannelPool()
-	defer p.Close()
-
-	connHolder, err := p.Get()
-	if err != nil {
-		t.Errorf("Get error: %s", err)
-	}
-
-	_, ok := connHolder.Conn.(GenericConn)
-	if !ok {
-		t.Errorf("Conn is not of type ConnectionHolder")
-	}
-}
-
-func TestChannelPool_GetWithTimeout(t *testing.T) {
-	pool, err := NewChannelPool(1, factory)
-	defer pool.Close()
-
-	_, err = pool.Get()
-	if err != nil {
-		t.Errorf("Get error: %s", err)
-	}
-
-	if pool.Len() != 0 {
-		t.Errorf("pool size is not exhausted")
-	}
-	_, err = pool.GetWithTimeout(100 * time.Millisecond)
-	if err == nil || !strings.HasPrefix(err.Error(), "timed out") {
-		t.Errorf("timeout error expected but not received")
-	}
-}
-
-func TestPool_Get(t *testing.T) {
-	p, _ := newChannelPool()
-	defer p.Close()
-
-	_, err := p.Get()
-	if err != nil {
-		t.Errorf("Get error: %s", err)
-	}
-
-	// after one get, current capacity should be lowered by one.
-	if p.Len() != (MaximumCap - 1) {
-		t.Errorf("Get error. Expecting %d, got %d",
-			(MaximumCap - 1), p.Len())
-	}
-
-	// exhaust he pool
-	var wg sync.WaitGroup
-	for i := 0; i < (MaximumCap - 1); i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			_, err := p.Get()
-			if err != nil {
-				t.Errorf("Get error: %s", err)
-			}
-		}()
-	}
-	wg.Wait()
-
-	if p.Len() != 0 {
-		t.Errorf("Get error. Expecting %d, got %d",
-			(MaximumCap - 1), p.Len())
-	}
-
-	// confirm that requesting a new connection from an empty pool results in a wait
-
-	waitMillis := 30
-	ctx, _ := context.WithTimeout(context.Background(), time.Duration(waitMillis)*time.Millisecond)
-	connChannel := make(chan GenericConn)
-	errorChannel := make(chan error)
-	timedOut := false
-
-	go func() {
-		conn, err := p.Get()
-		if err != nil {
-			errorChannel <- err
-		} else {
-			connChannel <- conn
-		}
-	}()
-	select {
-	case <-connChannel:
-		timedOut = false
-
-	case <-errorChannel:
-		timedOut = false
-
-	case <-ctx.Done():
-		timedOut = true
-	}
-	if !timedOut {
-		t.Errorf("Got a connection after pool was exhausted: %s", err)
-	}
-}
-
-func TestPool_PutTwiceNotAllowed(t *testing.T) {
-	p, err := NewChannelPool(2, factory)
+func TestNewChannelPool(t *testing.T) {
+	p, err := NewChannelPool(MaximumCap, factory)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("New error: %s", err)
 	}
 	defer p.Close()
 
-	conn1, err := p.Get()
-	_, err = p.Get()
-
-	p.Put(conn1)
-	// attempt to add the same conn twice
-	p.Put(conn1)
-
-	if p.Len() == 2 {
-		t.Errorf("put the same connection back to the pool twice")
-	}
-}
-
-func TestPool_Put(t *testing.T) {
-	p, err := NewChannelPool(30, factory)
+	conn, err := p.Get()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Get error: %s", err)
 	}
-	defer p.Close()
-
-	// get/create from the pool
-	conns := make([]*ConnectionHolder, MaximumCap)
-	for i := 0; i < MaximumCap; i++ {
-		conn, _ := p.Get()
-		conns[i] = conn
+	if _, ok := conn.Conn.(string); !ok {
+		t.Errorf("Conn is not the one created by the factory")
 	}
-
-	// now put them all back
-	for _, conn := range conns {
-		p.Put(conn)
+	if err := p.Put(conn); err != nil {
+		t.Errorf("Put error: %s", err)
 	}
-
-	if p.Len() != MaximumCap {
-		t.Errorf("Put error len. Expecting %d, got %d",
-			1, p.Len())
+	if err := p.Put(conn); err != ErrDoublePut {
+		t.Errorf("expected ErrDoublePut, got %v", err)
 	}
-
-	p.Close() // close pool
-
-	conn, _ := factory()
-	p.Put(NewConnectionHolder(conn))
-	if p.Len() != 0 {
-		t.Errorf("Put error. Closed pool shouldn't allow to put connections.")
+	if err := p.Put(NewConnectionHolder(conn.Conn)); err != ErrForeignConnection {
+		t.Errorf("expected ErrForeignConnection, got %v", err)
 	}
-}
-
-func TestPool_UsedCapacity(t *testing.T) {
-	p, _ := newChannelPool()
-	defer p.Close()
-
 	if p.Len() != MaximumCap {
-		t.Errorf("InitialCap error. Expecting %d, got %d",
-			MaximumCap, p.Len())
+		t.Errorf("Len error. Expecting %d, got %d", MaximumCap, p.Len())
 	}
 }
 
-func TestPool_Close(t *testing.T) {
-	p, _ := newChannelPool()
-
-	// now close it and test all cases we are expecting.
-	p.Close()
-
-	c := p.(*channelPool)
-
-	if c.conns != nil {
-		t.Errorf("Close error, conns channel should be nil")
+func TestNewChannelPoolWithOptions(t *testing.T) {
+	dialed := 0
+	netFactory := func() (GenericConn, error) {
+		dialed++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	var closed []GenericConn
+	closeFunc := func(conn GenericConn) error {
+		closed = append(closed, conn)
+		return conn.(net.Conn).Close()
+	}
+
+	p, err := NewChannelPoolWithOptions(netFactory, Options{
+		InitialCap: 1,
+		MaxCap:     2,
+		CloseFunc:  closeFunc,
+	})
+	if err != nil {
+		t.Fatalf("New error: %s", err)
 	}
 
-	if c.factory != nil {
-		t.Errorf("Close error, factory should be nil")
+	conn1, _ := p.Get()
+	conn2, _ := p.Get()
+	if dialed != 2 {
+		t.Errorf("expected 2 connections dialed, got %d", dialed)
 	}
-
-	_, err := p.Get()
-	if err == nil {
-		t.Errorf("Close error, get conn should return an error")
+	if _, err := p.GetWithTimeout(10 * time.Millisecond); !errors.Is(err, ErrTimedOut) {
+		t.Errorf("expected ErrTimedOut, got %v", err)
 	}
 
-	if p.Len() != 0 {
-		t.Errorf("Close error used capacity. Expecting 0, got %d", p.Len())
+	p.Put(conn1)
+	if err := p.Close(); err != nil {
+		t.Errorf("Close error: %s", err)
 	}
-}
-
-func TestPoolConcurrent(t *testing.T) {
-	p, _ := newChannelPool()
-	pipe := make(chan *ConnectionHolder, 0)
-
-	go func() {
-		p.Close()
-	}()
-
-	for i := 0; i < MaximumCap; i++ {
-		go func() {
-			conn, _ := p.Get()
-
-			pipe <- conn
-		}()
-
-		go func() {
-			conn := <-pipe
-			if conn == nil {
-				return
-			}
-			p.Put(conn)
-		}()
+	p.Put(conn2)
+	if len(closed) != 2 {
+		t.Errorf("expected both connections to be closed, got %d", len(closed))
 	}
-}
-
-func TestPoolConcurrent2(t *testing.T) {
-	p, _ := NewChannelPool(30, factory)
-
-	var wg sync.WaitGroup
-
-	go func() {
-		for i := 0; i < 10; i++ {
-			wg.Add(1)
-			go func(i int) {
-				conn, _ := p.Get()
-				time.Sleep(time.Millisecond * time.Duration(rand.Intn(100)))
-				p.Put(conn)
-				wg.Done()
-			}(i)
-		}
-	}()
-
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go func(i int) {
-			conn, _ := p.Get()
-			time.Sleep(time.Millisecond * time.Duration(rand.Intn(100)))
-			p.Put(conn)
-			wg.Done()
-		}(i)
+	if _, err := p.Get(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
 	}
-
-	wg.Wait()
-}
-
-func newChannelPool() (Pool, error) {
-	return NewChannelPool(MaximumCap, factory)
 }
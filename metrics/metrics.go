@@ -0,0 +1,200 @@
+// Package metrics exposes the statistics of named pools in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Magnetic/pool"
+)
+
+// ContentType is the content type of the text exposition format served by
+// a Registry.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// StatsSource is implemented by anything reporting pool statistics, such as
+// pool.Pool and adapters.PooledHttpClient.
+type StatsSource interface {
+	Stats() pool.Stats
+}
+
+// Registry collects the statistics of named pools on every scrape. It is an
+// http.Handler serving them in the Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	sources map[string]StatsSource
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{sources: make(map[string]StatsSource)}
+}
+
+// Register adds a pool to the registry. Its metrics are labelled with
+// pool="name" and name has to be unique within the registry.
+func (r *Registry) Register(name string, source StatsSource) error {
+	if source == nil {
+		return errors.New("stats source is nil")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sources[name]; ok {
+		return fmt.Errorf("pool %q is already registered", name)
+	}
+	r.sources[name] = source
+	return nil
+}
+
+// Unregister removes the pool registered under name, if any.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sources, name)
+}
+
+// ServeHTTP writes the metrics of all the registered pools.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// namedStats is a snapshot of the statistics of one registered pool.
+type namedStats struct {
+	name  string
+	stats pool.Stats
+}
+
+// metric describes a metric family derived from pool.Stats.
+type metric struct {
+	name, help, kind string
+	value            func(pool.Stats) float64
+}
+
+var (
+	// scalars are the metrics with one sample per pool
+	scalars = []metric{
+		{"pool_max_open_connections", "Maximum number of open connections.", "gauge",
+			func(s pool.Stats) float64 { return float64(s.MaxOpen) }},
+		{"pool_open_connections", "Number of open connections, idle, in use or being dialed.", "gauge",
+			func(s pool.Stats) float64 { return float64(s.Open) }},
+		{"pool_idle_connections", "Number of idle connections.", "gauge",
+			func(s pool.Stats) float64 { return float64(s.Idle) }},
+		{"pool_in_use_connections", "Number of connections currently borrowed.", "gauge",
+			func(s pool.Stats) float64 { return float64(s.InUse) }},
+		{"pool_wait_queue_length", "Number of callers queued waiting for a connection.", "gauge",
+			func(s pool.Stats) float64 { return float64(s.WaitQueue) }},
+		{"pool_timeouts_total", "Total number of waits given up because the context was done.", "counter",
+			func(s pool.Stats) float64 { return float64(s.Timeouts) }},
+		{"pool_factory_errors_total", "Total number of failed attempts to create a connection.", "counter",
+			func(s pool.Stats) float64 { return float64(s.FactoryErrors) }},
+		{"pool_leaked_connections_total", "Total number of connections reported as leaked.", "counter",
+			func(s pool.Stats) float64 { return float64(s.Leaks) }},
+	}
+
+	closeReasons = []struct {
+		reason string
+		value  func(pool.Stats) int64
+	}{
+		{"idle_time", func(s pool.Stats) int64 { return s.IdleClosed }},
+		{"lifetime", func(s pool.Stats) int64 { return s.LifetimeClosed }},
+		{"health_check", func(s pool.Stats) int64 { return s.HealthCheckClosed }},
+		{"discarded", func(s pool.Stats) int64 { return s.Discarded }},
+	}
+)
+
+// WriteTo writes the metrics of all the registered pools to w in the text
+// exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.sources))
+	sources := make([]StatsSource, 0, len(r.sources))
+	for name, source := range r.sources {
+		names = append(names, name)
+		sources = append(sources, source)
+	}
+	r.mu.Unlock()
+
+	// collect outside of the lock so that a slow source doesn't block
+	// registrations
+	snapshots := make([]namedStats, len(names))
+	for i := range names {
+		snapshots[i] = namedStats{name: names[i], stats: sources[i].Stats()}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].name < snapshots[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range scalars {
+		writeHeader(cw, m.name, m.help, m.kind)
+		for _, s := range snapshots {
+			fmt.Fprintf(cw, "%s{pool=\"%s\"} %s\n", m.name, escape(s.name), formatFloat(m.value(s.stats)))
+		}
+	}
+
+	writeHeader(cw, "pool_closed_connections_total", "Total number of connections closed by the pool, by reason.", "counter")
+	for _, s := range snapshots {
+		for _, reason := range closeReasons {
+			fmt.Fprintf(cw, "pool_closed_connections_total{pool=\"%s\",reason=\"%s\"} %d\n", escape(s.name), reason.reason, reason.value(s.stats))
+		}
+	}
+
+	writeHeader(cw, "pool_wait_duration_seconds", "Time spent waiting for a connection.", "histogram")
+	for _, s := range snapshots {
+		name := escape(s.name)
+		var cumulative int64
+		for i, bound := range pool.WaitBuckets {
+			cumulative += s.stats.WaitHistogram[i]
+			fmt.Fprintf(cw, "pool_wait_duration_seconds_bucket{pool=\"%s\",le=\"%s\"} %d\n", name, formatFloat(bound.Seconds()), cumulative)
+		}
+		cumulative += s.stats.WaitHistogram[len(pool.WaitBuckets)]
+		fmt.Fprintf(cw, "pool_wait_duration_seconds_bucket{pool=\"%s\",le=\"+Inf\"} %d\n", name, cumulative)
+		fmt.Fprintf(cw, "pool_wait_duration_seconds_sum{pool=\"%s\"} %s\n", name, formatFloat(s.stats.WaitDuration.Seconds()))
+		fmt.Fprintf(cw, "pool_wait_duration_seconds_count{pool=\"%s\"} %d\n", name, s.stats.WaitCount)
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes a label value as required by the text exposition format.
+func escape(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// countingWriter counts the bytes written and remembers the first error so
+// that the writes don't have to be checked one by one.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
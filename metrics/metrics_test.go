@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Magnetic/pool"
+)
+
+var factory = func() (pool.GenericConn, error) {
+	return "", nil
+}
+
+func TestRegistry_Register(t *testing.T) {
+	p, err := pool.NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	r := NewRegistry()
+	if err := r.Register("backend", p); err != nil {
+		t.Fatalf("Register error: %s", err)
+	}
+	if err := r.Register("backend", p); err == nil {
+		t.Errorf("expected an error registering the same name twice")
+	}
+	r.Unregister("backend")
+	if err := r.Register("backend", p); err != nil {
+		t.Errorf("Register error after Unregister: %s", err)
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	p, err := pool.NewChannelPool(2, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	other, err := pool.NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	p.Get()
+	other.Get()
+	other.GetWithTimeout(10 * time.Millisecond)
+
+	r := NewRegistry()
+	r.Register("backend", p)
+	r.Register(`with "quotes"`, other)
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	for _, line := range []string{
+		"# TYPE pool_open_connections gauge",
+		`pool_max_open_connections{pool="backend"} 2`,
+		`pool_idle_connections{pool="backend"} 1`,
+		`pool_in_use_connections{pool="backend"} 1`,
+		`pool_in_use_connections{pool="with \"quotes\""} 1`,
+		`pool_wait_queue_length{pool="backend"} 0`,
+		`pool_timeouts_total{pool="with \"quotes\""} 1`,
+		`pool_leaked_connections_total{pool="backend"} 0`,
+		`pool_closed_connections_total{pool="backend",reason="idle_time"} 0`,
+		`pool_closed_connections_total{pool="backend",reason="discarded"} 0`,
+		"# TYPE pool_wait_duration_seconds histogram",
+		`pool_wait_duration_seconds_bucket{pool="with \"quotes\"",le="0.005"} 0`,
+		`pool_wait_duration_seconds_bucket{pool="with \"quotes\"",le="+Inf"} 1`,
+		`pool_wait_duration_seconds_count{pool="backend"} 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, text)
+		}
+	}
+
+	// pools are listed in name order
+	if strings.Index(text, `pool_open_connections{pool="backend"}`) > strings.Index(text, `pool_open_connections{pool="with`) {
+		t.Errorf("expected pools to be sorted by name")
+	}
+}
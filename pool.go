@@ -1,43 +1,93 @@
 // Package pool implements a pool of net.Conn interfaces to manage and reuse them.
+//
+// The pool is a thin wrapper around the type-safe pool of package typed for
+// connections of any type held as GenericConn.
 package pool
 
 import (
-	"errors"
+	"context"
 	"time"
+
+	"github.com/Magnetic/pool/typed"
 )
 
 var (
 	// ErrClosed is the error resulting if the pool is closed via pool.Close().
-	ErrClosed   = errors.New("pool is closed")
-	ErrTimedOut = errors.New("timed out waiting for connection")
+	ErrClosed = typed.ErrClosed
+	// ErrTimedOut is the error resulting if no connection became available
+	// in time. Errors returned by GetContext wrap it along with ctx.Err().
+	ErrTimedOut = typed.ErrTimedOut
+	// ErrDoublePut is the error resulting if a connection is put back to the
+	// pool while it is not borrowed, e.g. when it was already put back.
+	ErrDoublePut = typed.ErrDoublePut
+	// ErrForeignConnection is the error resulting if a connection is put back
+	// to a pool other than the one it was borrowed from.
+	ErrForeignConnection = typed.ErrForeignConnection
+	// ErrCircuitOpen is the error resulting if a circuit breaker fails a call
+	// fast because the calls before it kept failing.
+	ErrCircuitOpen = typed.ErrCircuitOpen
 )
 
 type GenericConn interface{}
 
-type ConnectionHolder struct {
-	Conn  GenericConn
-	InUse bool
-}
+// ConnectionHolder wraps a connection handed out by a pool and tracks which
+// pool owns it and whether it is currently borrowed.
+type ConnectionHolder = typed.Holder[GenericConn]
 
+// NewConnectionHolder wraps conn in a holder which does not belong to any
+// pool.
 func NewConnectionHolder(conn GenericConn) *ConnectionHolder {
-	return &ConnectionHolder{Conn: conn}
+	return typed.NewHolder(conn)
 }
 
 // Pool interface describes a pool implementation. A pool should have maximum
 // capacity. An ideal pool is threadsafe and easy to use.
-type Pool interface {
-	// Get returns a new connection from the pool. Closing the connections puts
-	// it back to the Pool. Closing it when the pool is destroyed or full will
-	// be counted as an error.
-	Get() (*ConnectionHolder, error)
+type Pool = typed.Pool[GenericConn]
+
+// Stats contains pool statistics, much like sql.DBStats does for a sql.DB.
+type Stats = typed.Stats
+
+// WaitBuckets are the upper bounds of the buckets of Stats.WaitHistogram.
+var WaitBuckets = typed.WaitBuckets
+
+// CircuitBreaker stops dialing a failing backend for a while, see
+// Options.Breaker.
+type CircuitBreaker = typed.CircuitBreaker
+
+// NewCircuitBreaker returns a breaker which opens once failureRate of the
+// recent calls failed and which stays open for cooldown.
+func NewCircuitBreaker(failureRate float64, cooldown time.Duration) *CircuitBreaker {
+	return typed.NewCircuitBreaker(failureRate, cooldown)
+}
 
-	GetWithTimeout(time.Duration) (*ConnectionHolder, error)
+// Priority orders the callers waiting for a connection, see
+// typed.Priority.
+type Priority = typed.Priority
 
-	Put(*ConnectionHolder) error
-	// Close closes the pool and all its connections. After Close() the pool is
-	// no longer usable.
-	Close()
+// The predefined priorities, see typed.PriorityLow and the like.
+const (
+	PriorityLow    = typed.PriorityLow
+	PriorityNormal = typed.PriorityNormal
+	PriorityHigh   = typed.PriorityHigh
+)
 
-	// Len returns the current number of connections of the pool.
-	Len() int
+// WithPriority returns a copy of ctx carrying priority, GetContext made with
+// it waits for a connection with that priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return typed.WithPriority(ctx, priority)
 }
+
+// ReuseStrategy decides which idle connection Get reuses, see
+// Options.ReuseStrategy.
+type ReuseStrategy = typed.ReuseStrategy
+
+// The reuse strategies, see typed.ReuseFIFO and the like.
+const (
+	ReuseFIFO   = typed.ReuseFIFO
+	ReuseLIFO   = typed.ReuseLIFO
+	ReuseRandom = typed.ReuseRandom
+)
+
+// DialRetryPolicy retries failed attempts to create a connection, see
+// Options.DialRetry.
+type DialRetryPolicy = typed.DialRetryPolicy
@@ -0,0 +1,178 @@
+package typed
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error resulting if a circuit breaker fails a call
+// fast because the calls before it kept failing.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls through while keeping track of failures.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails calls fast until the cooldown has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets a trial call through, its outcome decides whether
+	// the breaker closes or opens again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breakerBuckets is the number of buckets the failure-rate window is split
+// into, old buckets fall out of the window one at a time.
+const breakerBuckets = 10
+
+// CircuitBreaker stops calls to a failing backend for a while. It opens once
+// the rate of failures within Window reaches FailureRate, fails calls with
+// ErrCircuitOpen for Cooldown and then lets a trial call through to decide
+// whether to close again.
+//
+// The settings must not be changed once the breaker is in use.
+type CircuitBreaker struct {
+	// FailureRate is the ratio of failed calls, between 0 and 1, which opens
+	// the breaker.
+	FailureRate float64
+	// MinRequests is the number of calls within Window needed before the
+	// failure rate is considered.
+	MinRequests int
+	// Window is the period over which the failure rate is computed.
+	Window time.Duration
+	// Cooldown is how long the breaker stays open before a trial call is let
+	// through, and how long a trial call may take to report its outcome
+	// before another one is let through.
+	Cooldown time.Duration
+
+	mu    sync.Mutex
+	state BreakerState
+	// changedAt is when the breaker opened, or when the last trial call was
+	// let through while half-open
+	changedAt time.Time
+	buckets   [breakerBuckets]breakerBucket
+}
+
+// breakerBucket counts the outcomes of the calls within a slice of the window.
+type breakerBucket struct {
+	epoch     int64
+	successes int
+	failures  int
+}
+
+// NewCircuitBreaker returns a breaker which opens once failureRate of at least
+// 5 calls within 10 seconds failed and which stays open for cooldown.
+func NewCircuitBreaker(failureRate float64, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureRate: failureRate,
+		MinRequests: 5,
+		Window:      10 * time.Second,
+		Cooldown:    cooldown,
+	}
+}
+
+// Allow reports whether a call may go ahead, it returns ErrCircuitOpen if it
+// may not.
+func (b *CircuitBreaker) Allow() error {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerClosed {
+		return nil
+	}
+	if now.Sub(b.changedAt) < b.Cooldown {
+		return ErrCircuitOpen
+	}
+	// let a trial call through, or another one if the previous trial didn't
+	// report back in time
+	b.state = BreakerHalfOpen
+	b.changedAt = now
+	return nil
+}
+
+// Success records a successful call.
+func (b *CircuitBreaker) Success() {
+	b.record(false)
+}
+
+// Failure records a failed call.
+func (b *CircuitBreaker) Failure() {
+	b.record(true)
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) record(failed bool) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		// late outcomes of calls let through before the breaker opened
+		return
+	case BreakerHalfOpen:
+		if failed {
+			b.state = BreakerOpen
+			b.changedAt = now
+		} else {
+			b.state = BreakerClosed
+			b.buckets = [breakerBuckets]breakerBucket{}
+		}
+		return
+	}
+
+	epoch := b.epoch(now)
+	bucket := &b.buckets[epoch%breakerBuckets]
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+	if failed {
+		bucket.failures++
+	} else {
+		bucket.successes++
+	}
+
+	var successes, failures int
+	for _, bucket := range b.buckets {
+		if epoch-bucket.epoch < breakerBuckets {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	total := successes + failures
+	if failed && total >= b.MinRequests && float64(failures) >= b.FailureRate*float64(total) {
+		b.state = BreakerOpen
+		b.changedAt = now
+	}
+}
+
+// epoch returns the index of the slice of time now falls into, the window
+// spans the last breakerBuckets of them.
+func (b *CircuitBreaker) epoch(now time.Time) int64 {
+	width := b.Window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return now.UnixNano() / int64(width)
+}
@@ -0,0 +1,77 @@
+package typed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(0.5, 20*time.Millisecond)
+	b.MinRequests = 4
+
+	// too few calls to judge the failure rate
+	b.Success()
+	b.Failure()
+	b.Failure()
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected closed breaker, got %s", b.State())
+	}
+
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", b.State())
+	}
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	// a trial call is let through after the cooldown and fails
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a trial call, got %v", err)
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open breaker, got %s", b.State())
+	}
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Errorf("expected a single trial call, got %v", err)
+	}
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected the failed trial to reopen the breaker, got %s", b.State())
+	}
+
+	// the next trial succeeds
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a trial call, got %v", err)
+	}
+	b.Success()
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected the successful trial to close the breaker, got %s", b.State())
+	}
+
+	// the failures before it are forgotten
+	b.Failure()
+	if b.State() != BreakerClosed {
+		t.Errorf("expected closed breaker, got %s", b.State())
+	}
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	b := NewCircuitBreaker(0.5, time.Second)
+	b.MinRequests = 2
+	b.Window = 20 * time.Millisecond
+
+	b.Failure()
+	time.Sleep(30 * time.Millisecond)
+	// the first failure fell out of the window
+	b.Failure()
+	if b.State() != BreakerClosed {
+		t.Errorf("expected closed breaker, got %s", b.State())
+	}
+	b.Failure()
+	if b.State() != BreakerOpen {
+		t.Errorf("expected open breaker, got %s", b.State())
+	}
+}
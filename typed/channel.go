@@ -0,0 +1,1140 @@
+package typed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fillRetryInterval is how long the filler waits before dialing again after
+// the factory failed to create a connection.
+var fillRetryInterval = time.Second
+
+// ChannelPool implements the Pool interface. Get calls which have to wait
+// for a connection are queued and served in FIFO order, a connection put
+// back goes straight to the caller waiting the longest.
+type ChannelPool[T any] struct {
+	// generator of generic connections
+	factory     FactoryContext[T]
+	closeFunc   func(T) error
+	minIdle     int
+	dialTimeout time.Duration
+	dialRetry   DialRetryPolicy
+
+	// health checks, see Options
+	testOnBorrow      func(T) error
+	testOnReturn      func(T) error
+	testIdleThreshold time.Duration
+
+	// expiry settings, see Options
+	maxIdleTime time.Duration
+	maxLifetime time.Duration
+
+	breaker *CircuitBreaker
+
+	reuse ReuseStrategy
+
+	// leak detection, see Options
+	leakThreshold time.Duration
+	onLeak        func(*Holder[T])
+
+	// reservations keep connections for callers of a high priority, see
+	// Options.Reserved
+	reservations []reservation
+
+	mu sync.Mutex
+	// maxCap is the maximum number of open connections, see Resize
+	maxCap int
+	// idle holds the idle connections, the least recently put back first
+	idle []*Holder[T]
+	// waiters holds the Get calls waiting for a connection, by priority
+	// and oldest first among equals
+	waiters []*waiter[T]
+	// numOpen is the number of connections created by the pool, idle or
+	// borrowed, that have not been closed yet
+	numOpen int
+	// borrowed holds the connections handed out and not put back yet
+	borrowed map[*Holder[T]]struct{}
+	closed   bool
+
+	// fill wakes up the filler, done stops it
+	fill chan struct{}
+	done chan struct{}
+	// drained is closed once the pool is closed and all its connections
+	// are, see Shutdown
+	drained chan struct{}
+	// closing is cancelled by Close to abort the dials in flight
+	closing       context.Context
+	cancelClosing context.CancelFunc
+
+	stats channelPoolStats
+}
+
+// channelPoolStats holds the counters reported by Stats, accessed atomically.
+type channelPoolStats struct {
+	inUse             int64
+	waitCount         int64
+	waitDuration      int64
+	timeouts          int64
+	factoryErrors     int64
+	idleClosed        int64
+	lifetimeClosed    int64
+	healthCheckClosed int64
+	discarded         int64
+	leaks             int64
+	waitHistogram     [len(WaitBuckets) + 1]int64
+}
+
+// observeWait accounts a wait for a connection which took d.
+func (s *channelPoolStats) observeWait(d time.Duration) {
+	atomic.AddInt64(&s.waitDuration, int64(d))
+	i := 0
+	for i < len(WaitBuckets) && d > WaitBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&s.waitHistogram[i], 1)
+}
+
+// waiter is a Get call queued for a connection.
+type waiter[T any] struct {
+	priority Priority
+	// ready receives the connection handed over to the waiter, or nil if it
+	// should try again because a slot was freed or the pool was closed
+	ready chan *Holder[T]
+}
+
+// closeReason tells why a connection was taken out of the pool.
+type closeReason int
+
+const (
+	closedIdleTime closeReason = iota + 1
+	closedLifetime
+	closedHealthCheck
+	closedDiscarded
+)
+
+// ReuseStrategy decides which idle connection Get reuses.
+type ReuseStrategy int
+
+const (
+	// ReuseFIFO reuses the connection idle for the longest time, spreading
+	// the load over all the idle connections and keeping them warm.
+	ReuseFIFO ReuseStrategy = iota
+	// ReuseLIFO reuses the connection put back last, so that connections
+	// in excess stay idle and are closed after MaxIdleTime.
+	ReuseLIFO
+	// ReuseRandom reuses a random idle connection.
+	ReuseRandom
+)
+
+// Factory is a function to create new connections.
+type Factory[T any] func() (T, error)
+
+// FactoryContext is a function to create new connections which gives up once
+// ctx is done.
+type FactoryContext[T any] func(ctx context.Context) (T, error)
+
+// withContext adapts a Factory to the FactoryContext of a pool with opts. A
+// Factory cannot be cancelled, with a DialTimeout a call outliving its
+// context is abandoned instead and the connection it eventually creates is
+// closed.
+func (f Factory[T]) withContext(opts Options[T]) FactoryContext[T] {
+	if f == nil {
+		return nil
+	}
+	if opts.DialTimeout == 0 {
+		return func(context.Context) (T, error) { return f() }
+	}
+	return func(ctx context.Context) (T, error) {
+		type result struct {
+			conn T
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			conn, err := f()
+			done <- result{conn, err}
+		}()
+
+		select {
+		case r := <-done:
+			return r.conn, r.err
+		case <-ctx.Done():
+		}
+		select {
+		case r := <-done:
+			return r.conn, r.err
+		default:
+			go func() {
+				if r := <-done; r.err == nil {
+					closeConnection(opts.CloseFunc, r.conn)
+				}
+			}()
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// Options configures a pool created with NewChannelPoolWithOptions.
+type Options[T any] struct {
+	// InitialCap is the number of connections dialed when the pool is
+	// created. Connections which cannot be dialed do not fail the pool,
+	// they are created later on demand instead, unless InitialRequired is
+	// set.
+	InitialCap int
+
+	// InitialRequired fails the creation of the pool if any of the
+	// InitialCap connections cannot be dialed, even after DialRetry. The
+	// connections dialed so far are closed then.
+	InitialRequired bool
+
+	// MinIdle is the number of idle connections a background filler tries
+	// to keep in the pool, as long as MaxCap permits.
+	MinIdle int
+
+	// MaxCap is the maximum number of open connections, idle or in use.
+	MaxCap int
+
+	// CloseFunc closes a connection which is removed from the pool. If it
+	// is nil, connections implementing io.Closer are closed through it.
+	CloseFunc func(T) error
+
+	// DialTimeout bounds every attempt to create a connection. Zero means
+	// no timeout. A plain Factory, which cannot be cancelled, is abandoned
+	// once it times out and the connection it eventually creates is closed.
+	DialTimeout time.Duration
+
+	// DialRetry retries failed attempts to create a connection while the
+	// pool is filled upon creation, kept at MinIdle or replaces a broken
+	// connection. Get dials only once, it doesn't wait for retries.
+	DialRetry DialRetryPolicy
+
+	// TestOnBorrow checks an idle connection before Get hands it out. A
+	// connection failing the check is closed and Get carries on with
+	// another idle connection or dials a new one.
+	TestOnBorrow func(T) error
+
+	// TestOnReturn checks a connection put back to the pool. A connection
+	// failing the check is closed and replaced in the background.
+	TestOnReturn func(T) error
+
+	// TestIdleThreshold restricts TestOnBorrow to connections which have
+	// been idle for longer than the threshold. Zero tests every connection.
+	TestIdleThreshold time.Duration
+
+	// MaxIdleTime is how long a connection may stay idle in the pool before
+	// it is closed. Zero keeps idle connections forever.
+	MaxIdleTime time.Duration
+
+	// MaxLifetime is how long a connection may be reused after it has been
+	// created. Zero reuses connections forever.
+	MaxLifetime time.Duration
+
+	// Breaker, if set, makes Get fail fast with ErrCircuitOpen while the
+	// factory or the health checks keep failing. It is fed with the outcome
+	// of every attempt to create a connection and of every health check,
+	// and only consulted when Get has to dial: idle connections are still
+	// handed out while it is open.
+	Breaker *CircuitBreaker
+
+	// ReuseStrategy decides which idle connection Get reuses, ReuseFIFO by
+	// default.
+	ReuseStrategy ReuseStrategy
+
+	// LeakThreshold reports connections borrowed for longer than the
+	// threshold as leaked, through OnLeak. The stack of every Get call is
+	// recorded then to tell where leaked connections were borrowed, see
+	// DebugDump. Zero disables leak detection.
+	LeakThreshold time.Duration
+
+	// OnLeak is called once for every connection borrowed for longer than
+	// LeakThreshold. If nil, leaks are logged with the standard logger.
+	OnLeak func(conn *Holder[T])
+
+	// Reserved keeps connections for callers of at least a priority: the
+	// last Reserved[p] connections available are only handed to callers
+	// with priority p or higher, see WithPriority.
+	Reserved map[Priority]int
+}
+
+// NewChannelPool returns a new pool with a fixed capacity. Factory is used
+// to populate the pool upon creation and the pool is not created if any of
+// the connections cannot be dialed.
+func NewChannelPool[T any](maxCap int, factory Factory[T]) (Pool[T], error) {
+	if maxCap <= 0 {
+		return nil, errors.New("invalid capacity settings")
+	}
+	return NewChannelPoolWithOptions(factory, Options[T]{
+		InitialCap:      maxCap,
+		MaxCap:          maxCap,
+		InitialRequired: true,
+	})
+}
+
+// NewChannelPoolWithOptions returns a new pool which creates connections
+// lazily. Up to opts.InitialCap connections are dialed upfront, further ones
+// are dialed by Get while fewer than opts.MaxCap are open, and opts.MinIdle
+// of them are kept warm in the background. Factory errors don't prevent the
+// pool from being created unless opts.InitialRequired is set, in which case
+// failing to dial any of the initial connections does.
+func NewChannelPoolWithOptions[T any](factory Factory[T], opts Options[T]) (Pool[T], error) {
+	return NewChannelPoolContext(factory.withContext(opts), opts)
+}
+
+// NewChannelPoolContext is like NewChannelPoolWithOptions but creates
+// connections through a factory which gives up once its context is done:
+// when opts.DialTimeout elapses, when the Get call dialing gives up or when
+// the pool is closed.
+func NewChannelPoolContext[T any](factory FactoryContext[T], opts Options[T]) (Pool[T], error) {
+	c, err := newChannelPoolContext(factory, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newChannelPoolContext creates the pool returned by NewChannelPoolContext.
+func newChannelPoolContext[T any](factory FactoryContext[T], opts Options[T]) (*ChannelPool[T], error) {
+	if opts.InitialCap < 0 || opts.InitialCap > opts.MaxCap {
+		return nil, errors.New("invalid initial capacity settings")
+	}
+	if opts.MaxIdleTime < 0 || opts.MaxLifetime < 0 {
+		return nil, errors.New("invalid expiry settings")
+	}
+	if opts.DialTimeout < 0 {
+		return nil, errors.New("invalid dial timeout")
+	}
+	if !opts.DialRetry.valid() {
+		return nil, errors.New("invalid dial retry settings")
+	}
+	if opts.LeakThreshold < 0 {
+		return nil, errors.New("invalid leak threshold")
+	}
+
+	c, err := makeChannelPool(factory, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// create initial connections, if something goes wrong and they are
+	// required, close those dialed so far and error out.
+	for i := 0; i < opts.InitialCap; i++ {
+		conn, err := c.dialWithRetry(context.Background())
+		if err != nil {
+			if opts.InitialRequired {
+				c.Close()
+				return nil, fmt.Errorf("factory is not able to fill the pool: %w", err)
+			}
+			continue
+		}
+		c.putIdle(conn)
+	}
+
+	if c.minIdle > 0 {
+		go c.filler()
+		c.signalFill()
+	}
+	if c.maxIdleTime > 0 || c.maxLifetime > 0 {
+		go c.reaper()
+	}
+	if c.leakThreshold > 0 {
+		go c.leakDetector()
+	}
+
+	return c, nil
+}
+
+func makeChannelPool[T any](factory FactoryContext[T], opts Options[T]) (*ChannelPool[T], error) {
+	if err := checkCapacity(opts.MaxCap, opts.MinIdle, opts.Reserved); err != nil {
+		return nil, err
+	}
+	if opts.ReuseStrategy < ReuseFIFO || opts.ReuseStrategy > ReuseRandom {
+		return nil, errors.New("invalid reuse strategy")
+	}
+	if factory == nil {
+		return nil, errors.New("factory is nil")
+	}
+
+	closing, cancelClosing := context.WithCancel(context.Background())
+	return &ChannelPool[T]{
+		factory:           factory,
+		closeFunc:         opts.CloseFunc,
+		maxCap:            opts.MaxCap,
+		minIdle:           opts.MinIdle,
+		dialTimeout:       opts.DialTimeout,
+		dialRetry:         opts.DialRetry,
+		testOnBorrow:      opts.TestOnBorrow,
+		testOnReturn:      opts.TestOnReturn,
+		testIdleThreshold: opts.TestIdleThreshold,
+		maxIdleTime:       opts.MaxIdleTime,
+		maxLifetime:       opts.MaxLifetime,
+		breaker:           opts.Breaker,
+		reuse:             opts.ReuseStrategy,
+		leakThreshold:     opts.LeakThreshold,
+		onLeak:            opts.OnLeak,
+		reservations:      makeReservations(opts.Reserved),
+		borrowed:          make(map[*Holder[T]]struct{}),
+		fill:              make(chan struct{}, 1),
+		done:              make(chan struct{}),
+		drained:           make(chan struct{}),
+		closing:           closing,
+		cancelClosing:     cancelClosing,
+	}, nil
+}
+
+// checkCapacity validates the capacity settings of a pool.
+func checkCapacity(maxCap, minIdle int, reserved map[Priority]int) error {
+	if maxCap <= 0 {
+		return errors.New("invalid capacity settings")
+	}
+	if minIdle < 0 || minIdle > maxCap {
+		return errors.New("invalid minimum idle settings")
+	}
+	total := 0
+	for _, n := range reserved {
+		if n < 0 {
+			return errors.New("invalid reserved capacity settings")
+		}
+		total += n
+	}
+	if total > maxCap {
+		return errors.New("invalid reserved capacity settings")
+	}
+	return nil
+}
+
+// dial creates a new connection through the factory if fewer than maxCap
+// connections are open. It returns a nil holder and no error if the pool
+// is already at capacity.
+func (c *ChannelPool[T]) dial(ctx context.Context) (*Holder[T], error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if c.numOpen >= c.maxCap {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.numOpen++ // reserve the slot while dialing
+	c.mu.Unlock()
+
+	return c.create(ctx)
+}
+
+// create creates a new connection through the factory in a slot which is
+// already reserved, the slot is freed again if the factory fails. The
+// factory gives up once ctx is done, DialTimeout elapses or the pool is
+// closed.
+func (c *ChannelPool[T]) create(parent context.Context) (*Holder[T], error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	stop := context.AfterFunc(c.closing, cancel)
+	defer stop()
+	if c.dialTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, c.dialTimeout)
+		defer cancelTimeout()
+	}
+
+	conn, err := c.factory(ctx)
+	if err != nil {
+		atomic.AddInt64(&c.stats.factoryErrors, 1)
+		c.mu.Lock()
+		c.freeSlot()
+		c.mu.Unlock()
+	}
+	// a dial aborted by the caller or by Close tells nothing about the
+	// backend
+	switch {
+	case c.closing.Err() != nil && err != nil:
+		return nil, ErrClosed
+	case parent.Err() != nil && err != nil:
+		atomic.AddInt64(&c.stats.timeouts, 1)
+		return nil, fmt.Errorf("%w: %w", ErrTimedOut, parent.Err())
+	}
+	c.report(err)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Holder[T]{Conn: conn, owner: c, createdAt: now, lastUsed: now}, nil
+}
+
+// freeSlot gives up the slot of a connection and lets the first waiter try
+// to dial in its place. The caller must hold mu.
+func (c *ChannelPool[T]) freeSlot() {
+	c.numOpen--
+	if w := c.popWaiter(c.available()); w != nil {
+		w.ready <- nil
+	}
+	c.checkDrained()
+}
+
+// checkDrained closes drained once the pool is closed and the last of its
+// connections is. The caller must hold mu.
+func (c *ChannelPool[T]) checkDrained() {
+	if c.closed && c.numOpen == 0 {
+		select {
+		case <-c.drained:
+		default:
+			close(c.drained)
+		}
+	}
+}
+
+// available returns the number of connections which could be handed out
+// right away, idle or yet to be dialed. The caller must hold mu.
+func (c *ChannelPool[T]) available() int {
+	return len(c.idle) + c.maxCap - c.numOpen
+}
+
+// putIdle hands the connection over to the first waiter or to the idle
+// connections, or closes it if the pool has been closed or shrunk in the
+// meantime.
+func (c *ChannelPool[T]) putIdle(conn *Holder[T]) error {
+	c.mu.Lock()
+	if c.closed || c.numOpen > c.maxCap {
+		c.mu.Unlock()
+		return c.closeConn(conn)
+	}
+
+	conn.lastUsed = time.Now()
+	if w := c.popWaiter(c.available() + 1); w != nil {
+		w.ready <- conn
+	} else {
+		c.idle = append(c.idle, conn)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// popIdle takes an idle connection out of the idle ones as the reuse
+// strategy decides, it returns nil if there is none. The caller must hold
+// mu.
+func (c *ChannelPool[T]) popIdle() *Holder[T] {
+	if len(c.idle) == 0 {
+		return nil
+	}
+
+	var i int
+	switch c.reuse {
+	case ReuseFIFO:
+		conn := c.idle[0]
+		c.idle[0] = nil
+		c.idle = c.idle[1:]
+		return conn
+	case ReuseLIFO:
+		i = len(c.idle) - 1
+	case ReuseRandom:
+		i = rand.Intn(len(c.idle))
+	}
+	conn := c.idle[i]
+	copy(c.idle[i:], c.idle[i+1:])
+	c.idle[len(c.idle)-1] = nil
+	c.idle = c.idle[:len(c.idle)-1]
+	return conn
+}
+
+// pushWaiter queues a new waiter behind those of the same priority, or in
+// front of them if it already waited before and lost its turn to another
+// caller. The caller must hold mu.
+func (c *ChannelPool[T]) pushWaiter(priority Priority, front bool) *waiter[T] {
+	w := &waiter[T]{priority: priority, ready: make(chan *Holder[T], 1)}
+	i := 0
+	for i < len(c.waiters) && (c.waiters[i].priority > priority || !front && c.waiters[i].priority == priority) {
+		i++
+	}
+	c.waiters = append(c.waiters, nil)
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = w
+	return w
+}
+
+// queuedAhead reports whether a caller with priority has to queue up behind
+// the waiters. The caller must hold mu.
+func (c *ChannelPool[T]) queuedAhead(priority Priority) bool {
+	return len(c.waiters) > 0 && c.waiters[0].priority >= priority
+}
+
+// eligible reports whether a caller with priority may take one of the
+// available connections without touching those reserved for higher
+// priorities.
+func (c *ChannelPool[T]) eligible(priority Priority, available int) bool {
+	return available > reservedAbove(c.reservations, priority)
+}
+
+// popWaiter takes the first waiter out of the queue if it may take one of
+// the available connections, it returns nil otherwise. The caller must hold
+// mu.
+func (c *ChannelPool[T]) popWaiter(available int) *waiter[T] {
+	// the first waiter has the highest priority, if it may not take a
+	// connection none of the others may
+	if len(c.waiters) == 0 || !c.eligible(c.waiters[0].priority, available) {
+		return nil
+	}
+	w := c.waiters[0]
+	c.waiters[0] = nil
+	c.waiters = c.waiters[1:]
+	return w
+}
+
+// removeWaiter takes w out of the queue, it reports false if w was already
+// handed something. The caller must hold mu.
+func (c *ChannelPool[T]) removeWaiter(w *waiter[T]) bool {
+	for i := range c.waiters {
+		if c.waiters[i] == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// replace dials a connection in the background to take the place of one
+// which was closed because it was broken.
+func (c *ChannelPool[T]) replace() {
+	go func() {
+		conn, err := c.dialWithRetry(c.closing)
+		if err != nil || conn == nil {
+			return
+		}
+		c.putIdle(conn)
+	}()
+}
+
+// expiry tells whether the connection outlived MaxIdleTime or MaxLifetime,
+// it returns zero if the connection can still be used.
+func (c *ChannelPool[T]) expiry(conn *Holder[T], now time.Time) closeReason {
+	if c.maxIdleTime > 0 && now.Sub(conn.lastUsed) > c.maxIdleTime {
+		return closedIdleTime
+	}
+	if c.maxLifetime > 0 && now.Sub(conn.createdAt) > c.maxLifetime {
+		return closedLifetime
+	}
+	return 0
+}
+
+// reaper periodically closes idle connections which expired and lets the
+// filler dial new ones if fewer than minIdle are left. It runs until the pool
+// is closed.
+func (c *ChannelPool[T]) reaper() {
+	interval := c.maxIdleTime
+	if interval == 0 || (c.maxLifetime > 0 && c.maxLifetime < interval) {
+		interval = c.maxLifetime
+	}
+	interval /= 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			for _, conn := range c.reap(now) {
+				c.evict(conn, c.expiry(conn, now))
+			}
+			c.signalFill()
+		}
+	}
+}
+
+// reap takes the expired connections out of the idle ones.
+func (c *ChannelPool[T]) reap(now time.Time) []*Holder[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+
+	var expired []*Holder[T]
+	idle := c.idle[:0]
+	for _, conn := range c.idle {
+		if c.expiry(conn, now) != 0 {
+			expired = append(expired, conn)
+		} else {
+			idle = append(idle, conn)
+		}
+	}
+	clear(c.idle[len(idle):])
+	c.idle = idle
+	return expired
+}
+
+// healthy runs TestOnBorrow on an idle connection unless it was used
+// recently enough. An expired or broken connection is closed.
+func (c *ChannelPool[T]) healthy(conn *Holder[T]) bool {
+	if reason := c.expiry(conn, time.Now()); reason != 0 {
+		c.evict(conn, reason)
+		return false
+	}
+	if c.testOnBorrow == nil || time.Since(conn.lastUsed) <= c.testIdleThreshold {
+		return true
+	}
+	err := c.testOnBorrow(conn.Conn)
+	c.report(err)
+	if err != nil {
+		c.evict(conn, closedHealthCheck)
+		return false
+	}
+	return true
+}
+
+// report feeds the outcome of creating or checking a connection to the
+// circuit breaker, if any.
+func (c *ChannelPool[T]) report(err error) {
+	if c.breaker == nil {
+		return
+	}
+	if err != nil {
+		c.breaker.Failure()
+	} else {
+		c.breaker.Success()
+	}
+}
+
+// signalFill wakes up the filler without blocking.
+func (c *ChannelPool[T]) signalFill() {
+	if c.minIdle == 0 {
+		return
+	}
+	select {
+	case c.fill <- struct{}{}:
+	default:
+	}
+}
+
+// filler dials connections into the pool until minIdle of them are idle or
+// the pool is at capacity. It runs until the pool is closed.
+func (c *ChannelPool[T]) filler() {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.fill:
+		case <-retry:
+		}
+
+		retry = nil
+		for c.Len() < c.minIdle {
+			conn, err := c.dialWithRetry(c.closing)
+			if err != nil {
+				retry = time.After(fillRetryInterval)
+				break
+			}
+			if conn == nil {
+				break
+			}
+			c.putIdle(conn)
+		}
+	}
+}
+
+// Get implements the Pool interfaces Get() method. If there is no new
+// connection available in the pool, the client blocks
+func (c *ChannelPool[T]) Get() (*Holder[T], error) {
+	return c.GetContext(context.Background())
+}
+
+// GetWithTimeout is like Get but gives up with ErrTimedOut once timeout
+// has elapsed without a connection becoming available.
+func (c *ChannelPool[T]) GetWithTimeout(timeout time.Duration) (*Holder[T], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := c.GetContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrTimedOut
+	}
+	return conn, err
+}
+
+// GetContext is like Get but gives up once ctx is done. The returned error
+// wraps both ErrTimedOut and ctx.Err(). It waits with the priority carried
+// by ctx, see WithPriority.
+func (c *ChannelPool[T]) GetContext(ctx context.Context) (*Holder[T], error) {
+	return c.get(ctx, PriorityFromContext(ctx))
+}
+
+// GetWithPriority is like GetContext but waits with priority.
+func (c *ChannelPool[T]) GetWithPriority(ctx context.Context, priority Priority) (*Holder[T], error) {
+	return c.get(ctx, priority)
+}
+
+func (c *ChannelPool[T]) get(ctx context.Context, priority Priority) (*Holder[T], error) {
+	defer c.signalFill()
+
+	// start is when the call started waiting, zero until it has to
+	var start time.Time
+	defer func() {
+		if !start.IsZero() {
+			c.stats.observeWait(time.Since(start))
+		}
+	}()
+
+	// waited tells whether the call already waited in the queue, it then
+	// goes ahead of the others
+	waited := false
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClosed
+		}
+
+		// prefer an idle connection, then try to dial a new one and only
+		// wait if the pool is at capacity. Callers queue up behind those
+		// already waiting with the same or a higher priority.
+		if (waited || !c.queuedAhead(priority)) && c.eligible(priority, c.available()) {
+			if conn := c.popIdle(); conn != nil {
+				c.mu.Unlock()
+				if !c.healthy(conn) {
+					continue
+				}
+				return c.borrow(conn), nil
+			}
+			if c.numOpen < c.maxCap {
+				// only dials are stopped by the breaker, so that the
+				// outcome of every trial it lets through is reported
+				if c.breaker != nil {
+					if err := c.breaker.Allow(); err != nil {
+						c.mu.Unlock()
+						return nil, err
+					}
+				}
+				c.numOpen++ // reserve the slot while dialing
+				c.mu.Unlock()
+				conn, err := c.create(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return c.borrow(conn), nil
+			}
+		}
+
+		w := c.pushWaiter(priority, waited)
+		c.mu.Unlock()
+		if !waited {
+			start = time.Now()
+			atomic.AddInt64(&c.stats.waitCount, 1)
+			waited = true
+		}
+
+		select {
+		case conn := <-w.ready:
+			if conn == nil || !c.healthy(conn) {
+				continue
+			}
+			return c.borrow(conn), nil
+		case <-ctx.Done():
+			c.cancelWait(w)
+			atomic.AddInt64(&c.stats.timeouts, 1)
+			return nil, fmt.Errorf("%w: %w", ErrTimedOut, ctx.Err())
+		}
+	}
+}
+
+// cancelWait takes a waiter which gave up out of the queue. Whatever was
+// handed to it in the meantime is passed on to the next waiter.
+func (c *ChannelPool[T]) cancelWait(w *waiter[T]) {
+	c.mu.Lock()
+	if c.removeWaiter(w) {
+		c.mu.Unlock()
+		return
+	}
+	conn := <-w.ready
+	if conn != nil {
+		c.mu.Unlock()
+		c.putIdle(conn)
+		return
+	}
+	if !c.closed {
+		if next := c.popWaiter(c.available()); next != nil {
+			next.ready <- nil
+		}
+	}
+	c.mu.Unlock()
+}
+
+// borrow hands out the connection to the caller of Get.
+func (c *ChannelPool[T]) borrow(conn *Holder[T]) *Holder[T] {
+	// the holder of the previous borrower stays released, so that a stale
+	// Put through it cannot take the connection from the new one
+	lease := &Holder[T]{
+		Conn:       conn.Conn,
+		owner:      c,
+		inUse:      1,
+		createdAt:  conn.createdAt,
+		lastUsed:   conn.lastUsed,
+		borrowedAt: time.Now(),
+	}
+	if c.leakThreshold > 0 {
+		lease.stack = debug.Stack()
+	}
+	c.mu.Lock()
+	c.borrowed[lease] = struct{}{}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.stats.inUse, 1)
+	return lease
+}
+
+// put puts the connection back to the pool. If the pool is closed, or conn
+// outlived MaxLifetime or fails TestOnReturn, conn is simply closed. A nil
+// conn will be rejected.
+func (c *ChannelPool[T]) Put(conn *Holder[T]) error {
+	if conn == nil {
+		return errors.New("connection is nil. rejecting")
+	}
+
+	if err := c.giveBack(conn); err != nil {
+		return err
+	}
+
+	if c.maxLifetime > 0 && time.Since(conn.createdAt) > c.maxLifetime {
+		c.evict(conn, closedLifetime)
+		c.replace()
+		return nil
+	}
+	if c.testOnReturn != nil {
+		err := c.testOnReturn(conn.Conn)
+		c.report(err)
+		if err != nil {
+			c.evict(conn, closedHealthCheck)
+			c.replace()
+			return nil
+		}
+	}
+
+	return c.putIdle(conn)
+}
+
+// Discard closes a borrowed connection which the caller knows to be broken
+// instead of putting it back, and dials a replacement in the background.
+// reason tells why the connection is broken, a non-nil reason is reported
+// to the Breaker as a failure.
+func (c *ChannelPool[T]) Discard(conn *Holder[T], reason error) error {
+	if conn == nil {
+		return errors.New("connection is nil. rejecting")
+	}
+	if err := c.giveBack(conn); err != nil {
+		return err
+	}
+
+	if reason != nil && c.breaker != nil {
+		c.breaker.Failure()
+	}
+	err := c.evict(conn, closedDiscarded)
+	c.replace()
+	return err
+}
+
+// giveBack takes a connection put back or discarded off the borrowed ones.
+func (c *ChannelPool[T]) giveBack(conn *Holder[T]) error {
+	if conn.owner != c {
+		return ErrForeignConnection
+	}
+	if !conn.release() {
+		return ErrDoublePut
+	}
+	atomic.AddInt64(&c.stats.inUse, -1)
+	c.mu.Lock()
+	delete(c.borrowed, conn)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *ChannelPool[T]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.idle)
+}
+
+// Stats returns a snapshot of the pool statistics.
+func (c *ChannelPool[T]) Stats() Stats {
+	c.mu.Lock()
+	maxCap, open, idle, waiting := c.maxCap, c.numOpen, len(c.idle), len(c.waiters)
+	c.mu.Unlock()
+
+	stats := Stats{
+		MaxOpen:           maxCap,
+		Open:              open,
+		Idle:              idle,
+		WaitQueue:         waiting,
+		InUse:             int(atomic.LoadInt64(&c.stats.inUse)),
+		WaitCount:         atomic.LoadInt64(&c.stats.waitCount),
+		WaitDuration:      time.Duration(atomic.LoadInt64(&c.stats.waitDuration)),
+		Timeouts:          atomic.LoadInt64(&c.stats.timeouts),
+		FactoryErrors:     atomic.LoadInt64(&c.stats.factoryErrors),
+		IdleClosed:        atomic.LoadInt64(&c.stats.idleClosed),
+		LifetimeClosed:    atomic.LoadInt64(&c.stats.lifetimeClosed),
+		HealthCheckClosed: atomic.LoadInt64(&c.stats.healthCheckClosed),
+		Discarded:         atomic.LoadInt64(&c.stats.discarded),
+		Leaks:             atomic.LoadInt64(&c.stats.leaks),
+	}
+	for i := range stats.WaitHistogram {
+		stats.WaitHistogram[i] = atomic.LoadInt64(&c.stats.waitHistogram[i])
+	}
+	return stats
+}
+
+// Resize changes the maximum number of open connections. Growing the pool
+// lets waiters dial new connections through the factory right away.
+// Shrinking it closes idle connections in excess, least recently used first,
+// and borrowed ones once they are put back.
+func (c *ChannelPool[T]) Resize(maxCap int) error {
+	reserved := make(map[Priority]int, len(c.reservations))
+	for _, r := range c.reservations {
+		reserved[r.priority] = r.n
+	}
+	if err := checkCapacity(maxCap, c.minIdle, reserved); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.maxCap = maxCap
+
+	var excess []*Holder[T]
+	for c.numOpen-len(excess) > c.maxCap && len(c.idle) > 0 {
+		excess = append(excess, c.idle[0])
+		c.idle[0] = nil
+		c.idle = c.idle[1:]
+	}
+	for n := c.available(); n > 0; n-- {
+		w := c.popWaiter(n)
+		if w == nil {
+			break
+		}
+		w.ready <- nil
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, conn := range excess {
+		errs = append(errs, c.closeConn(conn))
+	}
+	c.signalFill()
+	return errors.Join(errs...)
+}
+
+// closeIdle closes the least recently used idle connection, e.g. to make
+// room for a connection of another pool, and reports whether there was one.
+func (c *ChannelPool[T]) closeIdle() bool {
+	c.mu.Lock()
+	if c.closed || len(c.idle) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	conn := c.idle[0]
+	c.idle[0] = nil
+	c.idle = c.idle[1:]
+	c.mu.Unlock()
+
+	c.closeConn(conn)
+	return true
+}
+
+// Close closes the pool and every idle connection in it. Connections which
+// are still borrowed are closed once they are put back. The returned error
+// aggregates the errors of all the connections which failed to close.
+func (c *ChannelPool[T]) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.cancelClosing()
+
+	idle := c.idle
+	c.idle = nil
+	// wake up the waiters, they find the pool closed
+	for _, w := range c.waiters {
+		w.ready <- nil
+	}
+	c.waiters = nil
+	c.checkDrained()
+	c.mu.Unlock()
+
+	var errs []error
+	for _, conn := range idle {
+		if err := c.closeConn(conn); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown closes the pool like Close and then waits for the borrowed
+// connections to be put back and closed, or for the dials in flight to be
+// aborted. If ctx is done first it returns ctx.Err() along with the
+// connections which are still borrowed, in no particular order.
+func (c *ChannelPool[T]) Shutdown(ctx context.Context) ([]*Holder[T], error) {
+	err := c.Close()
+	select {
+	case <-c.drained:
+		return nil, err
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	borrowed := make([]*Holder[T], 0, len(c.borrowed))
+	for conn := range c.borrowed {
+		borrowed = append(borrowed, conn)
+	}
+	return borrowed, ctx.Err()
+}
+
+// evict closes a connection which is taken out of the pool for reason.
+func (c *ChannelPool[T]) evict(conn *Holder[T], reason closeReason) error {
+	switch reason {
+	case closedIdleTime:
+		atomic.AddInt64(&c.stats.idleClosed, 1)
+	case closedLifetime:
+		atomic.AddInt64(&c.stats.lifetimeClosed, 1)
+	case closedHealthCheck:
+		atomic.AddInt64(&c.stats.healthCheckClosed, 1)
+	case closedDiscarded:
+		atomic.AddInt64(&c.stats.discarded, 1)
+	}
+	return c.closeConn(conn)
+}
+
+// closeConn closes the underlying connection of a holder which is no longer
+// part of the pool and frees its slot.
+func (c *ChannelPool[T]) closeConn(conn *Holder[T]) error {
+	c.mu.Lock()
+	c.freeSlot()
+	c.mu.Unlock()
+
+	return closeConnection(c.closeFunc, conn.Conn)
+}
+
+// closeConnection closes conn through closeFunc, or io.Closer if closeFunc
+// is nil.
+func closeConnection[T any](closeFunc func(T) error, conn T) error {
+	if closeFunc != nil {
+		return closeFunc(conn)
+	}
+	if closer, ok := any(conn).(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,1458 @@
+package typed
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	MaximumCap = 30
+
+	factory = func() (string, error) {
+		return "", nil
+	}
+)
+
+func TestNew(t *testing.T) {
+	_, err := newChannelPool()
+	if err != nil {
+		t.Errorf("New error: %s", err)
+	}
+}
+func TestPool_Get_Impl(t *testing.T) {
+	p, _ := newChannelPool()
+	defer p.Close()
+
+	connHolder, err := p.Get()
+	if err != nil {
+		t.Errorf("Get error: %s", err)
+	}
+
+	if !connHolder.InUse() {
+		t.Errorf("Conn is not marked in use")
+	}
+}
+
+func TestChannelPool_GetWithTimeout(t *testing.T) {
+	pool, err := NewChannelPool(1, factory)
+	defer pool.Close()
+
+	_, err = pool.Get()
+	if err != nil {
+		t.Errorf("Get error: %s", err)
+	}
+
+	if pool.Len() != 0 {
+		t.Errorf("pool size is not exhausted")
+	}
+	_, err = pool.GetWithTimeout(100 * time.Millisecond)
+	if err == nil || !strings.HasPrefix(err.Error(), "timed out") {
+		t.Errorf("timeout error expected but not received")
+	}
+}
+
+func TestChannelPool_GetContext(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.GetContext(context.Background())
+	if err != nil {
+		t.Fatalf("GetContext error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = p.GetContext(ctx)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrTimedOut) {
+		t.Errorf("expected cancellation wrapped with ErrTimedOut, got %v", err)
+	}
+
+	p.Put(conn)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = p.GetContext(ctx); err != nil {
+		t.Errorf("GetContext error after Put: %s", err)
+	}
+}
+
+func TestNewChannelPoolWithOptions_FactoryErrors(t *testing.T) {
+	var mu sync.Mutex
+	dialed := 0
+	flakyFactory := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed++
+		if dialed%2 == 0 {
+			return "", errors.New("backend down")
+		}
+		return "", nil
+	}
+
+	p, err := NewChannelPoolWithOptions(flakyFactory, Options[string]{InitialCap: 4, MaxCap: 4})
+	if err != nil {
+		t.Fatalf("pool should be created despite factory errors: %s", err)
+	}
+	defer p.Close()
+
+	if p.Len() != 2 {
+		t.Errorf("expected 2 initial connections, got %d", p.Len())
+	}
+}
+
+func TestNewChannelPoolWithOptions_DialRetry(t *testing.T) {
+	var dialed int32
+	flakyFactory := func() (string, error) {
+		if atomic.AddInt32(&dialed, 1) <= 2 {
+			return "", errors.New("backend down")
+		}
+		return "", nil
+	}
+
+	p, err := NewChannelPoolWithOptions(flakyFactory, Options[string]{
+		InitialCap:      1,
+		MaxCap:          1,
+		InitialRequired: true,
+		DialRetry:       DialRetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("pool should be created once the factory recovers: %s", err)
+	}
+	defer p.Close()
+
+	if p.Len() != 1 {
+		t.Errorf("expected 1 initial connection, got %d", p.Len())
+	}
+	if stats := p.Stats(); stats.FactoryErrors != 2 {
+		t.Errorf("expected 2 factory errors, got %d", stats.FactoryErrors)
+	}
+}
+
+func TestNewChannelPoolWithOptions_InitialRequired(t *testing.T) {
+	errDown := errors.New("backend down")
+	var conns []*closerConn
+	closerFactory := func() (*closerConn, error) {
+		if len(conns) == 2 {
+			return nil, errDown
+		}
+		conn := &closerConn{}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+
+	_, err := NewChannelPoolWithOptions(closerFactory, Options[*closerConn]{
+		InitialCap:      3,
+		MaxCap:          3,
+		InitialRequired: true,
+		DialRetry:       DialRetryPolicy{MaxAttempts: 2},
+	})
+	if !errors.Is(err, errDown) {
+		t.Fatalf("expected the factory error to be wrapped, got %v", err)
+	}
+	for i, conn := range conns {
+		if atomic.LoadInt32(&conn.closed) != 1 {
+			t.Errorf("connection %d dialed before the failure was not closed", i)
+		}
+	}
+}
+
+// hangingFactory blocks until ctx is done, counting the calls aborted.
+func hangingFactory(aborted *int32) FactoryContext[string] {
+	return func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		atomic.AddInt32(aborted, 1)
+		return "", ctx.Err()
+	}
+}
+
+func TestChannelPool_DialTimeout(t *testing.T) {
+	var aborted int32
+	p, err := NewChannelPoolContext(hangingFactory(&aborted), Options[string]{
+		InitialCap:  1,
+		MaxCap:      1,
+		DialTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.Get(); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimedOut) {
+		t.Errorf("expected the dial to time out, got %v", err)
+	}
+	if n := atomic.LoadInt32(&aborted); n != 2 {
+		t.Errorf("expected the initial dial and the one of Get to time out, %d did", n)
+	}
+	if stats := p.Stats(); stats.FactoryErrors != 2 || stats.Open != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// the caller giving up first aborts the dial as well
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := p.GetContext(ctx); !errors.Is(err, ErrTimedOut) {
+		t.Errorf("expected ErrTimedOut, got %v", err)
+	}
+}
+
+func TestChannelPool_CloseCancelsDials(t *testing.T) {
+	var aborted int32
+	p, err := NewChannelPoolContext(hangingFactory(&aborted), Options[string]{MaxCap: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := p.Get()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Close to cancel the dial")
+	}
+	if atomic.LoadInt32(&aborted) != 1 {
+		t.Errorf("expected the dial to be cancelled")
+	}
+}
+
+func TestChannelPool_DialTimeout_Factory(t *testing.T) {
+	release := make(chan struct{})
+	hungFactory := func() (string, error) {
+		<-release
+		return "late", nil
+	}
+	closed := make(chan string, 1)
+	p, err := NewChannelPoolWithOptions(hungFactory, Options[string]{
+		MaxCap:      1,
+		DialTimeout: 10 * time.Millisecond,
+		CloseFunc: func(conn string) error {
+			closed <- conn
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// a plain factory cannot be cancelled but its result isn't waited for
+	if _, err := p.Get(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the dial to time out, got %v", err)
+	}
+	close(release)
+	select {
+	case conn := <-closed:
+		if conn != "late" {
+			t.Errorf("expected the late connection to be closed, got %q", conn)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the late connection to be closed")
+	}
+}
+
+func TestChannelPool_LazyDial(t *testing.T) {
+	var mu sync.Mutex
+	dialed := 0
+	countingFactory := func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed++
+		return "", nil
+	}
+
+	p, err := NewChannelPoolWithOptions(countingFactory, Options[string]{MaxCap: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if dialed != 0 {
+		t.Errorf("expected no connections upfront, got %d", dialed)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.GetWithTimeout(100 * time.Millisecond); err != nil {
+			t.Fatalf("Get error: %s", err)
+		}
+	}
+	if dialed != 2 {
+		t.Errorf("expected 2 connections dialed on demand, got %d", dialed)
+	}
+	if _, err := p.GetWithTimeout(30 * time.Millisecond); err != ErrTimedOut {
+		t.Errorf("expected ErrTimedOut beyond MaxCap, got %v", err)
+	}
+}
+
+func TestChannelPool_MinIdle(t *testing.T) {
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{MinIdle: 2, MaxCap: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	waitForLen(t, p, 2)
+
+	// borrowing one leaves room for the filler to dial the last one
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	waitForLen(t, p, 2)
+
+	// at capacity the filler cannot keep MinIdle warm anymore
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if p.Len() != 1 {
+		t.Errorf("expected 1 idle connection at capacity, got %d", p.Len())
+	}
+}
+
+func TestPool_Get(t *testing.T) {
+	p, _ := newChannelPool()
+	defer p.Close()
+
+	_, err := p.Get()
+	if err != nil {
+		t.Errorf("Get error: %s", err)
+	}
+
+	// after one get, current capacity should be lowered by one.
+	if p.Len() != (MaximumCap - 1) {
+		t.Errorf("Get error. Expecting %d, got %d",
+			(MaximumCap - 1), p.Len())
+	}
+
+	// exhaust he pool
+	var wg sync.WaitGroup
+	for i := 0; i < (MaximumCap - 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.Get()
+			if err != nil {
+				t.Errorf("Get error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p.Len() != 0 {
+		t.Errorf("Get error. Expecting %d, got %d",
+			(MaximumCap - 1), p.Len())
+	}
+
+	// confirm that requesting a new connection from an empty pool results in a wait
+
+	waitMillis := 30
+	ctx, _ := context.WithTimeout(context.Background(), time.Duration(waitMillis)*time.Millisecond)
+	connChannel := make(chan *Holder[string])
+	errorChannel := make(chan error)
+	timedOut := false
+
+	go func() {
+		conn, err := p.Get()
+		if err != nil {
+			errorChannel <- err
+		} else {
+			connChannel <- conn
+		}
+	}()
+	select {
+	case <-connChannel:
+		timedOut = false
+
+	case <-errorChannel:
+		timedOut = false
+
+	case <-ctx.Done():
+		timedOut = true
+	}
+	if !timedOut {
+		t.Errorf("Got a connection after pool was exhausted: %s", err)
+	}
+}
+
+func TestPool_PutTwiceNotAllowed(t *testing.T) {
+	p, err := NewChannelPool(2, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn1, err := p.Get()
+	_, err = p.Get()
+
+	if err := p.Put(conn1); err != nil {
+		t.Errorf("Put error: %s", err)
+	}
+	// attempt to add the same conn twice
+	if err := p.Put(conn1); err != ErrDoublePut {
+		t.Errorf("expected ErrDoublePut, got %v", err)
+	}
+
+	if p.Len() == 2 {
+		t.Errorf("put the same connection back to the pool twice")
+	}
+}
+
+func TestPool_StalePutAfterReborrow(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, _ := p.Get()
+	if err := p.Put(a); err != nil {
+		t.Fatalf("Put error: %s", err)
+	}
+	// the same connection is borrowed again by someone else
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Put(a); err != ErrDoublePut {
+		t.Errorf("expected the stale Put to fail with ErrDoublePut, got %v", err)
+	}
+	if !b.InUse() {
+		t.Errorf("the stale Put should not release the new borrower's holder")
+	}
+	if err := p.Put(b); err != nil {
+		t.Errorf("Put by the new borrower failed: %s", err)
+	}
+}
+
+func TestPool_PutForeignNotAllowed(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	other, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	conn, _ := factory()
+	if err := p.Put(NewHolder(conn)); err != ErrForeignConnection {
+		t.Errorf("expected ErrForeignConnection for an unowned holder, got %v", err)
+	}
+
+	otherConn, err := other.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put(otherConn); err != ErrForeignConnection {
+		t.Errorf("expected ErrForeignConnection for a holder of another pool, got %v", err)
+	}
+	if !otherConn.InUse() {
+		t.Errorf("rejected holder should still be borrowed from its own pool")
+	}
+	if p.Len() != 1 {
+		t.Errorf("foreign holder must not be added to the pool")
+	}
+}
+
+func TestPool_PutTwiceConcurrently(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 100; i++ {
+		conn, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var accepted int32
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if p.Put(conn) == nil {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if accepted != 1 {
+			t.Fatalf("expected exactly one Put to succeed, %d did", accepted)
+		}
+	}
+}
+
+func TestPool_Put(t *testing.T) {
+	p, err := NewChannelPool(30, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// get/create from the pool
+	conns := make([]*Holder[string], MaximumCap)
+	for i := 0; i < MaximumCap; i++ {
+		conn, _ := p.Get()
+		conns[i] = conn
+	}
+
+	// now put them all back
+	for _, conn := range conns {
+		p.Put(conn)
+	}
+
+	if p.Len() != MaximumCap {
+		t.Errorf("Put error len. Expecting %d, got %d",
+			1, p.Len())
+	}
+
+	p.Close() // close pool
+
+	conn, _ := factory()
+	p.Put(NewHolder(conn))
+	if p.Len() != 0 {
+		t.Errorf("Put error. Closed pool shouldn't allow to put connections.")
+	}
+}
+
+func TestPool_UsedCapacity(t *testing.T) {
+	p, _ := newChannelPool()
+	defer p.Close()
+
+	if p.Len() != MaximumCap {
+		t.Errorf("InitialCap error. Expecting %d, got %d",
+			MaximumCap, p.Len())
+	}
+}
+
+func TestPool_Close(t *testing.T) {
+	p, _ := newChannelPool()
+
+	// now close it and test all cases we are expecting.
+	p.Close()
+
+	c := p.(*ChannelPool[string])
+
+	if !c.closed {
+		t.Errorf("Close error, pool should be marked closed")
+	}
+
+	if c.numOpen != 0 {
+		t.Errorf("Close error, expected all connections closed, %d are open", c.numOpen)
+	}
+
+	_, err := p.Get()
+	if err != ErrClosed {
+		t.Errorf("Close error, get conn should return ErrClosed, got %v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close error, closing twice should be a no-op: %s", err)
+	}
+
+	if p.Len() != 0 {
+		t.Errorf("Close error used capacity. Expecting 0, got %d", p.Len())
+	}
+}
+
+func TestPool_Shutdown(t *testing.T) {
+	var conns []*closerConn
+	closerFactory := func() (*closerConn, error) {
+		conn := &closerConn{}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	p, err := NewChannelPoolWithOptions(closerFactory, Options[*closerConn]{InitialCap: 2, MaxCap: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	borrowed, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the borrowed connection holds up the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	leaked, err := p.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the shutdown to time out, got %v", err)
+	}
+	if len(leaked) != 1 || leaked[0] != borrowed {
+		t.Errorf("expected the borrowed connection to be reported, got %v", leaked)
+	}
+	if _, err := p.Get(); err != ErrClosed {
+		t.Errorf("expected Get to fail with ErrClosed during shutdown, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(borrowed)
+	}()
+	leaked, err = p.Shutdown(context.Background())
+	if err != nil || len(leaked) != 0 {
+		t.Errorf("expected a clean shutdown once put back, got %v, %v", leaked, err)
+	}
+	for i, conn := range conns {
+		if atomic.LoadInt32(&conn.closed) != 1 {
+			t.Errorf("connection %d was not closed", i)
+		}
+	}
+}
+
+type closerConn struct {
+	closed int32
+	err    error
+}
+
+func (c *closerConn) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return c.err
+}
+
+func TestPool_CloseClosesConnections(t *testing.T) {
+	var conns []*closerConn
+	closerFactory := func() (*closerConn, error) {
+		conn := &closerConn{}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+
+	p, err := NewChannelPool(3, closerFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	borrowed, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close error: %s", err)
+	}
+	closed := 0
+	for _, conn := range conns {
+		closed += int(atomic.LoadInt32(&conn.closed))
+	}
+	if closed != 2 {
+		t.Errorf("expected the 2 idle connections to be closed, got %d", closed)
+	}
+
+	// a borrowed connection is closed once it's put back
+	if err := p.Put(borrowed); err != nil {
+		t.Errorf("Put error: %s", err)
+	}
+	if atomic.LoadInt32(&borrowed.Conn.closed) != 1 {
+		t.Errorf("connection put back to a closed pool should be closed")
+	}
+}
+
+func TestPool_CloseFunc(t *testing.T) {
+	errFirst, errSecond := errors.New("first"), errors.New("second")
+	errs := []error{errFirst, errSecond, nil}
+	closeFunc := func(conn string) error {
+		err := errs[0]
+		errs = errs[1:]
+		return err
+	}
+
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{InitialCap: 3, MaxCap: 3, CloseFunc: closeFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Close()
+	if !errors.Is(err, errFirst) || !errors.Is(err, errSecond) {
+		t.Errorf("expected Close to aggregate connection errors, got %v", err)
+	}
+	if len(errs) != 0 {
+		t.Errorf("expected CloseFunc to be called for every connection")
+	}
+}
+
+func TestPool_TestOnBorrow(t *testing.T) {
+	var dialed int32
+	countingFactory := func() (int, error) {
+		return int(atomic.AddInt32(&dialed, 1)), nil
+	}
+	var closed []int
+	closeFunc := func(conn int) error {
+		closed = append(closed, conn)
+		return nil
+	}
+	testOnBorrow := func(conn int) error {
+		if conn <= 2 {
+			return errors.New("broken")
+		}
+		return nil
+	}
+
+	p, err := NewChannelPoolWithOptions(countingFactory, Options[int]{
+		InitialCap:   2,
+		MaxCap:       2,
+		CloseFunc:    closeFunc,
+		TestOnBorrow: testOnBorrow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.GetWithTimeout(100 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Get error: %s", err)
+	}
+	if conn.Conn != 3 {
+		t.Errorf("expected broken connections to be replaced by a new one, got %v", conn.Conn)
+	}
+	if len(closed) != 2 {
+		t.Errorf("expected both broken connections to be closed, got %v", closed)
+	}
+}
+
+func TestPool_TestIdleThreshold(t *testing.T) {
+	var tested int32
+	testOnBorrow := func(conn string) error {
+		atomic.AddInt32(&tested, 1)
+		return nil
+	}
+
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		InitialCap:        1,
+		MaxCap:            1,
+		TestOnBorrow:      testOnBorrow,
+		TestIdleThreshold: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	p.Put(conn)
+	if tested != 0 {
+		t.Errorf("recently used connection should not be tested")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	conn, _ = p.Get()
+	p.Put(conn)
+	if tested != 1 {
+		t.Errorf("connection idle beyond the threshold should be tested")
+	}
+}
+
+func TestPool_TestOnReturn(t *testing.T) {
+	var closed int32
+	closeFunc := func(string) error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+	testOnReturn := func(conn string) error {
+		return errors.New("broken")
+	}
+
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		InitialCap:   1,
+		MaxCap:       1,
+		CloseFunc:    closeFunc,
+		TestOnReturn: testOnReturn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	if err := p.Put(conn); err != nil {
+		t.Errorf("Put error: %s", err)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("connection failing TestOnReturn should be closed")
+	}
+	waitForLen(t, p, 1)
+}
+
+func TestPool_Discard(t *testing.T) {
+	var closed int32
+	closeFunc := func(string) error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+	breaker := NewCircuitBreaker(0.5, time.Minute)
+	breaker.MinRequests = 1
+
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		InitialCap: 1,
+		MaxCap:     1,
+		CloseFunc:  closeFunc,
+		Breaker:    breaker,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	if err := p.Discard(conn, errors.New("broken")); err != nil {
+		t.Errorf("Discard error: %s", err)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("discarded connection should be closed")
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("expected the reason to be reported to the breaker")
+	}
+	if err := p.Discard(conn, nil); err != ErrDoublePut {
+		t.Errorf("expected ErrDoublePut, got %v", err)
+	}
+	if err := p.Put(conn); err != ErrDoublePut {
+		t.Errorf("expected ErrDoublePut, got %v", err)
+	}
+
+	// the slot is freed and a replacement dialed
+	waitForLen(t, p, 1)
+	stats := p.Stats()
+	if stats.Discarded != 1 || stats.InUse != 0 || stats.Open != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPool_Discard_NoReason(t *testing.T) {
+	// the replacement dial hangs so that it doesn't report to the breaker
+	release := make(chan struct{})
+	var dialed int32
+	hangingFactory := func() (string, error) {
+		if atomic.AddInt32(&dialed, 1) > 1 {
+			<-release
+		}
+		return "", nil
+	}
+	breaker := NewCircuitBreaker(0.5, 10*time.Millisecond)
+	breaker.MinRequests = 1
+	p, err := NewChannelPoolWithOptions(hangingFactory, Options[string]{InitialCap: 1, MaxCap: 1, Breaker: breaker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	defer close(release)
+
+	conn, _ := p.Get()
+	breaker.Failure()
+	time.Sleep(15 * time.Millisecond)
+	breaker.Allow()
+
+	// discarding a connection without a reason tells nothing about the
+	// backend
+	if err := p.Discard(conn, nil); err != nil {
+		t.Errorf("Discard error: %s", err)
+	}
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("expected the breaker to stay half-open, got %s", breaker.State())
+	}
+}
+
+func TestPool_MaxIdleTime(t *testing.T) {
+	var closed int32
+	closeFunc := func(string) error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		InitialCap:  3,
+		MaxCap:      3,
+		CloseFunc:   closeFunc,
+		MaxIdleTime: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	before := time.Now()
+	waitForLen(t, p, 0)
+	if atomic.LoadInt32(&closed) != 2 {
+		t.Errorf("expected the idle connections to be closed, %d were", closed)
+	}
+
+	// the borrowed connection is still fine to be reused
+	p.Put(conn)
+	if p.Len() != 1 || conn.LastUsed().Before(before) {
+		t.Errorf("expected the connection put back to be idle again")
+	}
+}
+
+func TestPool_ReuseStrategy(t *testing.T) {
+	for _, test := range []struct {
+		strategy ReuseStrategy
+		reused   int
+	}{
+		{ReuseFIFO, 0},
+		{ReuseLIFO, 2},
+	} {
+		dialed := 0
+		numberedFactory := func() (string, error) {
+			dialed++
+			return strconv.Itoa(dialed), nil
+		}
+		p, err := NewChannelPoolWithOptions(numberedFactory, Options[string]{MaxCap: 3, ReuseStrategy: test.strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var conns []*Holder[string]
+		for i := 0; i < 3; i++ {
+			conn, _ := p.Get()
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			p.Put(conn)
+		}
+		if conn, _ := p.Get(); conn.Conn != conns[test.reused].Conn {
+			t.Errorf("strategy %d: expected connection %d to be reused", test.strategy, test.reused)
+		}
+		p.Close()
+	}
+
+	if _, err := NewChannelPoolWithOptions(factory, Options[string]{MaxCap: 1, ReuseStrategy: 42}); err == nil {
+		t.Errorf("expected an unknown strategy to be rejected")
+	}
+}
+
+// TestPool_ReuseLIFO_ShrinksIdle shows that under a light load only LIFO
+// lets the connections in excess age out.
+func TestPool_ReuseLIFO_ShrinksIdle(t *testing.T) {
+	for _, test := range []struct {
+		strategy ReuseStrategy
+		open     int
+	}{
+		{ReuseFIFO, 4},
+		{ReuseLIFO, 1},
+	} {
+		p, err := NewChannelPoolWithOptions(factory, Options[string]{
+			InitialCap:    4,
+			MaxCap:        4,
+			MaxIdleTime:   40 * time.Millisecond,
+			ReuseStrategy: test.strategy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// one connection at a time is enough for the load
+		for deadline := time.Now().Add(150 * time.Millisecond); time.Now().Before(deadline); {
+			conn, _ := p.Get()
+			p.Put(conn)
+			time.Sleep(2 * time.Millisecond)
+		}
+		if open := p.Stats().Open; open != test.open {
+			t.Errorf("strategy %d: expected %d open connections, got %d", test.strategy, test.open, open)
+		}
+		p.Close()
+	}
+}
+
+func TestPool_MaxLifetime(t *testing.T) {
+	var closed int32
+	closeFunc := func(string) error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		InitialCap:  2,
+		MinIdle:     2,
+		MaxCap:      2,
+		CloseFunc:   closeFunc,
+		MaxLifetime: 30 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	created := conn.CreatedAt()
+	time.Sleep(40 * time.Millisecond)
+
+	// an expired connection is not taken back
+	p.Put(conn)
+	if atomic.LoadInt32(&closed) < 2 {
+		t.Errorf("expected expired connections to be closed, %d were", closed)
+	}
+
+	// and the pool is refilled to MinIdle with fresh connections
+	waitForLen(t, p, 2)
+	conn, _ = p.Get()
+	if !conn.CreatedAt().After(created) {
+		t.Errorf("expected a fresh connection after expiry")
+	}
+}
+
+func TestPool_Breaker(t *testing.T) {
+	var dialed int32
+	failingFactory := func() (string, error) {
+		atomic.AddInt32(&dialed, 1)
+		return "", errors.New("backend down")
+	}
+	breaker := NewCircuitBreaker(0.5, time.Hour)
+	breaker.MinRequests = 3
+
+	p, err := NewChannelPoolWithOptions(failingFactory, Options[string]{MaxCap: 2, Breaker: breaker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected the factory error, got %v", err)
+		}
+	}
+	if _, err := p.Get(); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if n := atomic.LoadInt32(&dialed); n != 3 {
+		t.Errorf("expected no dial while the breaker is open, got %d dials", n)
+	}
+}
+
+func TestPool_Breaker_IdleConnections(t *testing.T) {
+	var dialed int32
+	flakyFactory := func() (string, error) {
+		if atomic.AddInt32(&dialed, 1) == 2 {
+			return "", errors.New("backend down")
+		}
+		return "", nil
+	}
+	breaker := NewCircuitBreaker(0.5, 10*time.Millisecond)
+	breaker.MinRequests = 2
+
+	p, err := NewChannelPoolWithOptions(flakyFactory, Options[string]{InitialCap: 1, MaxCap: 2, Breaker: breaker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	if _, err := p.Get(); err == nil {
+		t.Fatal("expected the factory error")
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("expected open breaker, got %s", breaker.State())
+	}
+	p.Put(conn)
+
+	// the idle connection is still handed out while the breaker is open
+	for i := 0; i < 10; i++ {
+		conn, err := p.Get()
+		if err != nil {
+			t.Fatalf("expected the idle connection, got %v", err)
+		}
+		p.Put(conn)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("expected the breaker to stay open, got %s", breaker.State())
+	}
+
+	// the next dial after the cooldown is the trial, and closes the breaker
+	time.Sleep(15 * time.Millisecond)
+	conn, _ = p.Get()
+	if _, err := p.Get(); err != nil {
+		t.Fatalf("expected the trial dial to succeed, got %v", err)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("expected the trial to close the breaker, got %s", breaker.State())
+	}
+}
+
+func TestPool_FIFOWaiters(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	served := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			var conn *Holder[string]
+			if i == 1 {
+				// waiters with and without a timeout share the same queue
+				conn, _ = p.GetWithTimeout(time.Second)
+			} else {
+				conn, _ = p.Get()
+			}
+			served <- i
+			p.Put(conn)
+		}(i)
+		waitForQueue(t, p, i+1)
+	}
+	if queued := p.Stats().WaitQueue; queued != 3 {
+		t.Errorf("expected 3 queued waiters, got %d", queued)
+	}
+
+	p.Put(conn)
+	for i := 0; i < 3; i++ {
+		if got := <-served; got != i {
+			t.Errorf("expected waiter %d to be served, got %d", i, got)
+		}
+	}
+	if queued := p.Stats().WaitQueue; queued != 0 {
+		t.Errorf("expected an empty queue, got %d", queued)
+	}
+}
+
+func TestPool_FIFOWaiters_Cancelled(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := p.GetContext(ctx)
+		cancelled <- err
+	}()
+	waitForQueue(t, p, 1)
+	served := make(chan *Holder[string])
+	go func() {
+		conn, _ := p.Get()
+		served <- conn
+	}()
+	waitForQueue(t, p, 2)
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, ErrTimedOut) {
+		t.Errorf("expected ErrTimedOut, got %v", err)
+	}
+	waitForQueue(t, p, 1)
+
+	// the connection goes to the waiter left in the queue
+	p.Put(conn)
+	select {
+	case conn := <-served:
+		p.Put(conn)
+	case <-time.After(time.Second):
+		t.Fatalf("expected the remaining waiter to be served")
+	}
+}
+
+func TestPool_Resize(t *testing.T) {
+	var closed int32
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		InitialCap: 2,
+		MaxCap:     2,
+		CloseFunc: func(string) error {
+			atomic.AddInt32(&closed, 1)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn1, _ := p.Get()
+	conn2, _ := p.Get()
+	served := make(chan *Holder[string])
+	go func() {
+		conn, _ := p.Get()
+		served <- conn
+	}()
+	waitForQueue(t, p, 1)
+
+	// growing lets the waiter dial a new connection
+	if err := p.Resize(4); err != nil {
+		t.Fatal(err)
+	}
+	conn3 := <-served
+	if stats := p.Stats(); stats.MaxOpen != 4 || stats.Open != 3 {
+		t.Errorf("unexpected stats after growing %+v", stats)
+	}
+
+	// shrinking closes the idle connections in excess right away and the
+	// borrowed ones once they are put back
+	p.Put(conn1)
+	if err := p.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&closed) != 1 || p.Len() != 0 {
+		t.Errorf("expected the idle connection to be closed, %d were", closed)
+	}
+	p.Put(conn2)
+	if atomic.LoadInt32(&closed) != 2 || p.Len() != 0 {
+		t.Errorf("expected the connection put back to be closed, %d were", closed)
+	}
+	p.Put(conn3)
+	if atomic.LoadInt32(&closed) != 2 || p.Len() != 1 {
+		t.Errorf("expected the connection within capacity to be kept")
+	}
+	if stats := p.Stats(); stats.MaxOpen != 1 || stats.Open != 1 {
+		t.Errorf("unexpected stats after shrinking %+v", stats)
+	}
+
+	if err := p.Resize(0); err == nil {
+		t.Errorf("expected an invalid capacity to be rejected")
+	}
+	p.Close()
+	if err := p.Resize(2); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPool_Stats(t *testing.T) {
+	var fail int32
+	flakyFactory := func() (string, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return "", errors.New("backend down")
+		}
+		return "", nil
+	}
+
+	p, err := NewChannelPoolWithOptions(flakyFactory, Options[string]{
+		InitialCap:   2,
+		MaxCap:       2,
+		TestOnBorrow: func(string) error { return errors.New("broken") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	stats := p.Stats()
+	if stats.MaxOpen != 2 || stats.Open != 2 || stats.Idle != 2 || stats.InUse != 0 {
+		t.Errorf("unexpected initial stats %+v", stats)
+	}
+
+	// both idle connections fail the health check and are replaced
+	conn1, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = p.Stats()
+	if stats.HealthCheckClosed != 2 || stats.Open != 2 || stats.Idle != 0 || stats.InUse != 2 {
+		t.Errorf("unexpected stats after borrowing %+v", stats)
+	}
+
+	if _, err := p.GetWithTimeout(20 * time.Millisecond); err != ErrTimedOut {
+		t.Fatalf("expected ErrTimedOut, got %v", err)
+	}
+	stats = p.Stats()
+	if stats.WaitCount != 1 || stats.Timeouts != 1 || stats.WaitDuration < 20*time.Millisecond {
+		t.Errorf("unexpected wait stats %+v", stats)
+	}
+	var waits int64
+	for i, count := range stats.WaitHistogram {
+		waits += count
+		if count == 1 && i < len(WaitBuckets) && WaitBuckets[i] < stats.WaitDuration {
+			t.Errorf("wait of %s accounted in bucket up to %s", stats.WaitDuration, WaitBuckets[i])
+		}
+	}
+	if waits != stats.WaitCount {
+		t.Errorf("expected %d waits in the histogram, got %d", stats.WaitCount, waits)
+	}
+
+	p.Put(conn1)
+	p.Put(conn2)
+	atomic.StoreInt32(&fail, 1)
+	// the health check frees the slots which cannot be dialed again
+	if _, err := p.Get(); err == nil {
+		t.Fatalf("expected the factory error")
+	}
+	stats = p.Stats()
+	if stats.FactoryErrors != 1 || stats.HealthCheckClosed != 4 || stats.Open != 0 || stats.InUse != 0 {
+		t.Errorf("unexpected stats with a failing factory %+v", stats)
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	p, _ := newChannelPool()
+	pipe := make(chan *Holder[string], 0)
+
+	go func() {
+		p.Close()
+	}()
+
+	for i := 0; i < MaximumCap; i++ {
+		go func() {
+			conn, _ := p.Get()
+
+			pipe <- conn
+		}()
+
+		go func() {
+			conn := <-pipe
+			if conn == nil {
+				return
+			}
+			p.Put(conn)
+		}()
+	}
+}
+
+func TestPoolConcurrent2(t *testing.T) {
+	p, _ := NewChannelPool(30, factory)
+
+	var wg sync.WaitGroup
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				conn, _ := p.Get()
+				time.Sleep(time.Millisecond * time.Duration(rand.Intn(100)))
+				p.Put(conn)
+				wg.Done()
+			}(i)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			conn, _ := p.Get()
+			time.Sleep(time.Millisecond * time.Duration(rand.Intn(100)))
+			p.Put(conn)
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func waitForQueue[T any](t *testing.T, p Pool[T], n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().WaitQueue != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued waiters, got %d", n, p.Stats().WaitQueue)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForLen[T any](t *testing.T, p Pool[T], n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for p.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d idle connections, got %d", n, p.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestPoolStress_CloseDuringGetPut hammers Close concurrently with Get and
+// Put and is meant to be run with -race. Every connection created by the
+// pool has to be closed exactly once in the end.
+func TestPoolStress_CloseDuringGetPut(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		var created, closed int32
+		countingFactory := func() (string, error) {
+			atomic.AddInt32(&created, 1)
+			return "", nil
+		}
+		closeFunc := func(string) error {
+			atomic.AddInt32(&closed, 1)
+			return nil
+		}
+
+		p, err := NewChannelPoolWithOptions(countingFactory, Options[string]{
+			InitialCap: 2,
+			MinIdle:    2,
+			MaxCap:     5,
+			CloseFunc:  closeFunc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 20; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for {
+					var conn *Holder[string]
+					var err error
+					switch g % 3 {
+					case 0:
+						conn, err = p.Get()
+					case 1:
+						conn, err = p.GetWithTimeout(time.Millisecond)
+					default:
+						ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+						conn, err = p.GetContext(ctx)
+						cancel()
+					}
+					if err == ErrClosed {
+						return
+					}
+					if err != nil {
+						continue
+					}
+					p.Len()
+					p.Put(conn)
+				}
+			}(g)
+		}
+
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		var closers sync.WaitGroup
+		for g := 0; g < 3; g++ {
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				p.Close()
+			}()
+		}
+		closers.Wait()
+		wg.Wait()
+
+		if c, d := atomic.LoadInt32(&created), atomic.LoadInt32(&closed); c != d {
+			t.Fatalf("created %d connections but closed %d", c, d)
+		}
+	}
+}
+
+func newChannelPool() (Pool[string], error) {
+	return NewChannelPool(MaximumCap, factory)
+}
@@ -0,0 +1,623 @@
+package typed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyedFactory is a function to create new connections to the backend
+// identified by key, e.g. a shard.
+type KeyedFactory[K comparable, T any] func(key K) (T, error)
+
+// KeyedOptions configure a KeyedPool.
+type KeyedOptions[T any] struct {
+	// Options are those of the pool of every key, MaxCap being the capacity
+	// per key.
+	Options[T]
+	// MaxTotal caps the number of connections open across all keys, idle
+	// or borrowed. Zero means no cap. A key which has to dial while the cap
+	// is reached closes an idle connection of any key to make room, or
+	// waits for one to be put back or closed, callers of a higher priority
+	// going first.
+	MaxTotal int
+	// MaxKeyIdleTime closes the pool of a key once none of its connections
+	// was borrowed for that long. Zero means the pools are kept until the
+	// keyed pool is closed.
+	MaxKeyIdleTime time.Duration
+}
+
+// KeyedPool keeps a separate pool of connections for every key, such as the
+// shards of a Redis or Memcached cluster. The pool of a key is created on
+// first use and behaves like a pool created by NewChannelPoolWithOptions.
+type KeyedPool[K comparable, T any] struct {
+	factory        KeyedFactory[K, T]
+	opts           Options[T]
+	maxKeyIdleTime time.Duration
+
+	// maxTotal caps the connections open across all keys, zero if uncapped
+	maxTotal int
+	// timeouts counts the waits for the pool of a key to be created given
+	// up, accessed atomically
+	timeouts int64
+
+	mu      sync.Mutex
+	keys    map[K]*keyedEntry[T]
+	keyOpts map[K]Options[T]
+	// numOpen is the number of connections open or being dialed across all
+	// keys, admissions holds the dials waiting for it to drop below
+	// maxTotal by priority, oldest first among equals
+	numOpen    int
+	admissions []*admission
+	// retired holds the counters of the pools of evicted keys so that the
+	// totals reported by Stats never go down
+	retired Stats
+	closed  bool
+	done    chan struct{}
+}
+
+// keyedEntry is the pool of one key.
+type keyedEntry[T any] struct {
+	// pool is nil while it is being created, ready is closed once it is
+	// created or err tells why it could not be
+	pool  *ChannelPool[T]
+	ready chan struct{}
+	err   error
+	// borrowed is the number of connections borrowed or being waited for,
+	// guarded by the mutex of the keyed pool
+	borrowed int
+	lastUsed time.Time
+}
+
+// admission is a dial waiting for the connections open across all keys to
+// drop below MaxTotal.
+type admission struct {
+	priority Priority
+	// ready is closed once the dial may go ahead
+	ready chan struct{}
+}
+
+// NewKeyedPool returns a keyed pool creating the pool of every key with
+// opts.Options and connections through factory.
+func NewKeyedPool[K comparable, T any](factory KeyedFactory[K, T], opts KeyedOptions[T]) (*KeyedPool[K, T], error) {
+	if factory == nil {
+		return nil, errors.New("factory is nil")
+	}
+	if opts.MaxCap <= 0 || opts.MaxTotal < 0 {
+		return nil, errors.New("invalid capacity settings")
+	}
+	if opts.MaxKeyIdleTime < 0 {
+		return nil, errors.New("invalid expiry settings")
+	}
+
+	k := &KeyedPool[K, T]{
+		factory:        factory,
+		opts:           opts.Options,
+		maxKeyIdleTime: opts.MaxKeyIdleTime,
+		maxTotal:       opts.MaxTotal,
+		keys:           make(map[K]*keyedEntry[T]),
+		keyOpts:        make(map[K]Options[T]),
+		done:           make(chan struct{}),
+	}
+	if k.maxKeyIdleTime > 0 {
+		go k.reaper()
+	}
+	return k, nil
+}
+
+// SetKeyOptions overrides the options of the pool for key. It fails while
+// the pool for key is in use.
+func (k *KeyedPool[K, T]) SetKeyOptions(key K, opts Options[T]) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[key]; ok {
+		return fmt.Errorf("pool for key %v is already in use", key)
+	}
+	k.keyOpts[key] = opts
+	return nil
+}
+
+// acquire returns the pool for key, creating it if needed, and accounts for
+// a connection about to be borrowed from it so that it isn't evicted. It
+// gives up waiting for the pool to be created once ctx is done.
+func (k *KeyedPool[K, T]) acquire(ctx context.Context, key K) (*keyedEntry[T], error) {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return nil, ErrClosed
+	}
+	entry, ok := k.keys[key]
+	if !ok {
+		entry = &keyedEntry[T]{ready: make(chan struct{})}
+		k.keys[key] = entry
+	}
+	entry.borrowed++
+	entry.lastUsed = time.Now()
+	k.mu.Unlock()
+
+	if !ok {
+		// the pool may dial its initial connections, so it is created
+		// without holding the lock while the callers for key wait for it
+		go k.create(key, entry)
+	}
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		k.unacquire(entry)
+		atomic.AddInt64(&k.timeouts, 1)
+		return nil, fmt.Errorf("%w: %w", ErrTimedOut, ctx.Err())
+	}
+	if entry.err != nil {
+		k.unacquire(entry)
+		return nil, entry.err
+	}
+	return entry, nil
+}
+
+// create creates the pool of entry, which was added for key, and makes the
+// entry ready. The entry is removed again if the pool cannot be created.
+func (k *KeyedPool[K, T]) create(key K, entry *keyedEntry[T]) {
+	k.mu.Lock()
+	opts := k.options(key)
+	k.mu.Unlock()
+	pool, err := k.newPool(key, opts)
+
+	k.mu.Lock()
+	// catch up with the Resize calls made in the meantime, which didn't see
+	// the pool yet
+	for err == nil && !k.closed && k.options(key).MaxCap != opts.MaxCap {
+		opts.MaxCap = k.options(key).MaxCap
+		k.mu.Unlock()
+		pool.Resize(opts.MaxCap)
+		k.mu.Lock()
+	}
+	closed := err == nil && k.closed
+	if closed {
+		err = ErrClosed
+	}
+	if err != nil {
+		delete(k.keys, key)
+	} else {
+		entry.pool = pool
+	}
+	entry.err = err
+	k.mu.Unlock()
+
+	if closed {
+		pool.Close()
+	}
+	close(entry.ready)
+}
+
+// newPool creates the pool for key with opts. With MaxTotal, its factory
+// waits for a connection to be admitted before dialing and its CloseFunc
+// gives the connection's place up again.
+func (k *KeyedPool[K, T]) newPool(key K, opts Options[T]) (*ChannelPool[T], error) {
+	factory := Factory[T](func() (T, error) { return k.factory(key) }).withContext(opts)
+	if k.maxTotal == 0 {
+		return newChannelPoolContext(factory, opts)
+	}
+
+	closeFunc := opts.CloseFunc
+	opts.CloseFunc = func(conn T) error {
+		defer k.release()
+		return closeConnection(closeFunc, conn)
+	}
+	return newChannelPoolContext(func(ctx context.Context) (T, error) {
+		if err := k.admit(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+		conn, err := factory(ctx)
+		if err != nil {
+			k.release()
+		}
+		return conn, err
+	}, opts)
+}
+
+// options returns the options of the pool for key. The caller must hold mu.
+func (k *KeyedPool[K, T]) options(key K) Options[T] {
+	if opts, ok := k.keyOpts[key]; ok {
+		return opts
+	}
+	return k.opts
+}
+
+// unacquire undoes acquire once a connection is put back or wasn't borrowed
+// after all.
+func (k *KeyedPool[K, T]) unacquire(entry *keyedEntry[T]) {
+	k.mu.Lock()
+	entry.borrowed--
+	entry.lastUsed = time.Now()
+	k.mu.Unlock()
+}
+
+// Get returns a connection for key, blocking until one is available.
+func (k *KeyedPool[K, T]) Get(key K) (*Holder[T], error) {
+	return k.GetContext(context.Background(), key)
+}
+
+// GetWithTimeout is like Get but gives up with ErrTimedOut once timeout
+// has elapsed without a connection becoming available.
+func (k *KeyedPool[K, T]) GetWithTimeout(key K, timeout time.Duration) (*Holder[T], error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := k.GetContext(ctx, key)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, ErrTimedOut
+	}
+	return conn, err
+}
+
+// GetContext is like Get but gives up once ctx is done, including the wait
+// for MaxTotal to admit a new connection. The returned error wraps both
+// ErrTimedOut and ctx.Err(). Both waits are served by the priority carried
+// by ctx, see WithPriority.
+func (k *KeyedPool[K, T]) GetContext(ctx context.Context, key K) (*Holder[T], error) {
+	entry, err := k.acquire(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the total is only waited for when the pool of key dials, so that the
+	// callers waiting for a saturated key don't hold up the other keys
+	conn, err := entry.pool.GetContext(ctx)
+	if err != nil {
+		k.unacquire(entry)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// admit waits for the connections open across all keys to drop below
+// MaxTotal and accounts for one more about to be dialed, dials of a higher
+// priority going first. While it waits, an idle connection is closed to make
+// room if there is one.
+func (k *KeyedPool[K, T]) admit(ctx context.Context) error {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return ErrClosed
+	}
+	// the connections are at the cap as long as anyone waits, release hands
+	// their places over straight to the first waiter
+	if k.numOpen < k.maxTotal {
+		k.numOpen++
+		k.mu.Unlock()
+		return nil
+	}
+	a := &admission{priority: PriorityFromContext(ctx), ready: make(chan struct{})}
+	i := 0
+	for i < len(k.admissions) && k.admissions[i].priority >= a.priority {
+		i++
+	}
+	k.admissions = append(k.admissions, nil)
+	copy(k.admissions[i+1:], k.admissions[i:])
+	k.admissions[i] = a
+	k.mu.Unlock()
+	k.makeRoom()
+
+	// the pool dialing accounts for the wait given up
+	var err error
+	select {
+	case <-a.ready:
+		return nil
+	case <-k.done:
+		err = ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if !k.cancelAdmission(a) {
+		// admitted in the meantime, pass it on
+		k.release()
+	}
+	return err
+}
+
+// cancelAdmission takes a caller which gave up out of the queue, it reports
+// false if it was admitted already.
+func (k *KeyedPool[K, T]) cancelAdmission(a *admission) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i := range k.admissions {
+		if k.admissions[i] == a {
+			k.admissions = append(k.admissions[:i], k.admissions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Put puts a connection back to the pool for key it was borrowed from.
+func (k *KeyedPool[K, T]) Put(key K, conn *Holder[T]) error {
+	return k.giveBack(key, conn, func(pool *ChannelPool[T]) error { return pool.Put(conn) })
+}
+
+// Discard closes a broken connection borrowed for key instead of putting it
+// back, see ChannelPool.Discard.
+func (k *KeyedPool[K, T]) Discard(key K, conn *Holder[T], reason error) error {
+	return k.giveBack(key, conn, func(pool *ChannelPool[T]) error { return pool.Discard(conn, reason) })
+}
+
+// giveBack hands a connection borrowed for key back to its pool through
+// put, accounting for it once the pool accepted it. The pool accepts it even
+// if closing it fails.
+func (k *KeyedPool[K, T]) giveBack(key K, conn *Holder[T], put func(*ChannelPool[T]) error) error {
+	if conn == nil {
+		return errors.New("connection is nil. rejecting")
+	}
+	k.mu.Lock()
+	entry, ok := k.keys[key]
+	var pool *ChannelPool[T]
+	if ok {
+		pool = entry.pool
+	}
+	k.mu.Unlock()
+	if pool == nil {
+		return ErrForeignConnection
+	}
+
+	err := put(pool)
+	if err == ErrForeignConnection || err == ErrDoublePut {
+		return err
+	}
+	k.unacquire(entry)
+	// the connection may be idle now while dials wait for MaxTotal
+	k.makeRoom()
+	return err
+}
+
+// makeRoom closes an idle connection of any key if dials are waiting for
+// MaxTotal, its place goes to the first of them.
+func (k *KeyedPool[K, T]) makeRoom() {
+	if k.maxTotal == 0 {
+		return
+	}
+	k.mu.Lock()
+	if len(k.admissions) == 0 {
+		k.mu.Unlock()
+		return
+	}
+	pools := make([]*ChannelPool[T], 0, len(k.keys))
+	for _, entry := range k.keys {
+		if entry.pool != nil {
+			pools = append(pools, entry.pool)
+		}
+	}
+	k.mu.Unlock()
+
+	for _, pool := range pools {
+		if pool.closeIdle() {
+			return
+		}
+	}
+}
+
+// release accounts for a connection closed or not dialed after all, letting
+// the first dial waiting for MaxTotal go ahead in its place.
+func (k *KeyedPool[K, T]) release() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.admissions) > 0 {
+		close(k.admissions[0].ready)
+		k.admissions[0] = nil
+		k.admissions = k.admissions[1:]
+		return
+	}
+	k.numOpen--
+}
+
+// Len returns the number of idle connections across all keys.
+func (k *KeyedPool[K, T]) Len() int {
+	n := 0
+	for _, pool := range k.pools() {
+		n += pool.Len()
+	}
+	return n
+}
+
+// Stats returns the statistics of the pools of all keys added up. WaitQueue
+// also counts the dials waiting for MaxTotal and Timeouts the waits for the
+// pool of a key to be created given up.
+func (k *KeyedPool[K, T]) Stats() Stats {
+	k.mu.Lock()
+	stats := k.retired
+	stats.WaitQueue += len(k.admissions)
+	k.mu.Unlock()
+
+	stats.Timeouts += atomic.LoadInt64(&k.timeouts)
+	for _, pool := range k.pools() {
+		stats.add(pool.Stats())
+	}
+	return stats
+}
+
+// KeyStats returns the statistics of the pool for key, if there is one.
+func (k *KeyedPool[K, T]) KeyStats(key K) (Stats, bool) {
+	k.mu.Lock()
+	entry, ok := k.keys[key]
+	var pool *ChannelPool[T]
+	if ok {
+		pool = entry.pool
+	}
+	k.mu.Unlock()
+	if pool == nil {
+		return Stats{}, false
+	}
+	return pool.Stats(), true
+}
+
+// DebugDump writes the connections currently borrowed from the pool of
+// every key to w, see ChannelPool.DebugDump.
+func (k *KeyedPool[K, T]) DebugDump(w io.Writer) error {
+	k.mu.Lock()
+	keys := make([]K, 0, len(k.keys))
+	pools := make(map[K]Pool[T], len(k.keys))
+	for key, entry := range k.keys {
+		if entry.pool != nil {
+			keys = append(keys, key)
+			pools[key] = entry.pool
+		}
+	}
+	k.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "== %v: ", key); err != nil {
+			return err
+		}
+		if err := pools[key].DebugDump(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resize changes the capacity of the pool of every key, including those
+// created later, see ChannelPool.Resize. Keys with options of their own, see
+// SetKeyOptions, keep their capacity.
+func (k *KeyedPool[K, T]) Resize(maxCap int) error {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return ErrClosed
+	}
+	if err := checkCapacity(maxCap, k.opts.MinIdle, k.opts.Reserved); err != nil {
+		k.mu.Unlock()
+		return err
+	}
+
+	k.opts = resized(k.opts, maxCap)
+	pools := make([]Pool[T], 0, len(k.keys))
+	for key, entry := range k.keys {
+		if _, ok := k.keyOpts[key]; !ok && entry.pool != nil {
+			pools = append(pools, entry.pool)
+		}
+	}
+	k.mu.Unlock()
+
+	var errs []error
+	for _, pool := range pools {
+		errs = append(errs, pool.Resize(maxCap))
+	}
+	return errors.Join(errs...)
+}
+
+// resized returns opts with a capacity of maxCap.
+func resized[T any](opts Options[T], maxCap int) Options[T] {
+	opts.MaxCap = maxCap
+	if opts.InitialCap > maxCap {
+		opts.InitialCap = maxCap
+	}
+	return opts
+}
+
+// Close closes the pools of all keys. Connections which are still borrowed
+// are closed once they are put back.
+func (k *KeyedPool[K, T]) Close() error {
+	k.close()
+
+	var errs []error
+	for _, pool := range k.pools() {
+		errs = append(errs, pool.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown closes the pools of all keys and waits until the borrowed
+// connections are put back and closed. If ctx is done first, it returns an
+// error wrapping ctx.Err() along with the connections still borrowed across
+// all keys.
+func (k *KeyedPool[K, T]) Shutdown(ctx context.Context) ([]*Holder[T], error) {
+	k.close()
+
+	var borrowed []*Holder[T]
+	var errs []error
+	timedOut := false
+	for _, pool := range k.pools() {
+		conns, err := pool.Shutdown(ctx)
+		borrowed = append(borrowed, conns...)
+		switch {
+		case err == nil:
+		case err == ctx.Err():
+			timedOut = true
+		default:
+			errs = append(errs, err)
+		}
+	}
+	if timedOut {
+		errs = append(errs, ctx.Err())
+	}
+	return borrowed, errors.Join(errs...)
+}
+
+// close stops the keyed pool from creating pools for new keys.
+func (k *KeyedPool[K, T]) close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.closed {
+		k.closed = true
+		close(k.done)
+	}
+}
+
+func (k *KeyedPool[K, T]) pools() []Pool[T] {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pools := make([]Pool[T], 0, len(k.keys))
+	for _, entry := range k.keys {
+		// pools being created are closed by create if need be
+		if entry.pool != nil {
+			pools = append(pools, entry.pool)
+		}
+	}
+	return pools
+}
+
+// reaper closes the pools of idle keys until the keyed pool is closed.
+func (k *KeyedPool[K, T]) reaper() {
+	interval := k.maxKeyIdleTime / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case now := <-ticker.C:
+			for _, pool := range k.reap(now) {
+				pool.Close()
+			}
+		}
+	}
+}
+
+// reap takes the pools of the keys idle since before now-MaxKeyIdleTime out
+// of the keyed pool.
+func (k *KeyedPool[K, T]) reap(now time.Time) []Pool[T] {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var idle []Pool[T]
+	for key, entry := range k.keys {
+		if entry.pool == nil || entry.borrowed > 0 || now.Sub(entry.lastUsed) < k.maxKeyIdleTime {
+			continue
+		}
+		delete(k.keys, key)
+		stats := entry.pool.Stats()
+		stats.MaxOpen, stats.Open, stats.Idle, stats.InUse = 0, 0, 0, 0
+		k.retired.add(stats)
+		idle = append(idle, entry.pool)
+	}
+	return idle
+}
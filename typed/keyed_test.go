@@ -0,0 +1,373 @@
+package typed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func shardFactory(shard string) (string, error) {
+	return shard, nil
+}
+
+func TestKeyedPool(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, err := p.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Conn != "a" {
+		t.Errorf("expected a connection to shard a, got %q", a.Conn)
+	}
+	// each key has its own capacity
+	if _, err := p.GetWithTimeout("a", 10*time.Millisecond); err != ErrTimedOut {
+		t.Errorf("expected ErrTimedOut, got %v", err)
+	}
+	b, err := p.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Put("c", a); err != ErrForeignConnection {
+		t.Errorf("expected ErrForeignConnection for an unknown key, got %v", err)
+	}
+	if err := p.Put("b", a); err != ErrForeignConnection {
+		t.Errorf("expected ErrForeignConnection for another key, got %v", err)
+	}
+	if err := p.Put("a", a); err != nil {
+		t.Errorf("Put error: %s", err)
+	}
+	if err := p.Put("a", a); err != ErrDoublePut {
+		t.Errorf("expected ErrDoublePut, got %v", err)
+	}
+	p.Put("b", b)
+
+	stats := p.Stats()
+	if stats.MaxOpen != 2 || stats.Idle != 2 || stats.Timeouts != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats, ok := p.KeyStats("a"); !ok || stats.Timeouts != 1 {
+		t.Errorf("unexpected stats of key a %+v", stats)
+	}
+
+	p.Close()
+	if _, err := p.Get("a"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestKeyedPool_SlowKeyCreation(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slowFactory := func(shard string) (string, error) {
+		if shard == "slow" {
+			close(started)
+			<-release
+		}
+		return shard, nil
+	}
+	p, err := NewKeyedPool(slowFactory, KeyedOptions[string]{Options: Options[string]{InitialCap: 1, MaxCap: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := p.Get("slow")
+		slow <- err
+	}()
+	<-started
+
+	// the other keys are served while the pool of the slow one is filled
+	if _, err := p.GetWithTimeout("fast", 100*time.Millisecond); err != nil {
+		t.Errorf("expected a connection to the fast shard, got %v", err)
+	}
+	if _, err := p.GetWithTimeout("slow", 10*time.Millisecond); err != ErrTimedOut {
+		t.Errorf("expected to time out waiting for the slow shard, got %v", err)
+	}
+	if stats := p.Stats(); stats.InUse != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("expected a connection to the slow shard, got %v", err)
+	}
+}
+
+func TestKeyedPool_MaxTotal(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 2}, MaxTotal: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, _ := p.Get("a")
+	b, _ := p.Get("b")
+
+	// key a has room left but the total is capped
+	if _, err := p.GetWithTimeout("a", 10*time.Millisecond); err != ErrTimedOut {
+		t.Errorf("expected ErrTimedOut, got %v", err)
+	}
+	if timeouts := p.Stats().Timeouts; timeouts != 1 {
+		t.Errorf("expected the wait for the total cap to be counted, got %d timeouts", timeouts)
+	}
+
+	p.Put("a", a)
+	a, err = p.GetWithTimeout("a", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected a connection once one is put back, got %v", err)
+	}
+	p.Put("a", a)
+	p.Put("b", b)
+
+	// idle connections count as well, one of them makes room for a new key
+	if _, err := p.GetWithTimeout("c", 100*time.Millisecond); err != nil {
+		t.Errorf("expected an idle connection to be closed for key c, got %v", err)
+	}
+	if stats := p.Stats(); stats.Open != 2 || stats.Idle != 1 || stats.InUse != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestKeyedPool_MaxTotal_Priority(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 1}, MaxTotal: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, _ := p.Get("a")
+	served := make(chan string, 2)
+	get := func(key string, priority Priority) {
+		conn, err := p.GetContext(WithPriority(context.Background(), priority), key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		served <- key
+		p.Put(key, conn)
+	}
+	waitForAdmissions := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for p.Stats().WaitQueue != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d waiters, got %d", n, p.Stats().WaitQueue)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	go get("batch", PriorityLow)
+	waitForAdmissions(1)
+	go get("interactive", PriorityHigh)
+	waitForAdmissions(2)
+
+	p.Put("a", a)
+	if first := <-served; first != "interactive" {
+		t.Errorf("expected the high priority caller to go first, got %s", first)
+	}
+	if second := <-served; second != "batch" {
+		t.Errorf("expected the low priority caller to go next, got %s", second)
+	}
+}
+
+func TestKeyedPool_Discard(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 1}, MaxTotal: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	a, _ := p.Get("a")
+	if err := p.Discard("b", a, nil); err != ErrForeignConnection {
+		t.Errorf("expected ErrForeignConnection, got %v", err)
+	}
+	if err := p.Discard("a", a, errors.New("broken")); err != nil {
+		t.Errorf("Discard error: %s", err)
+	}
+	if err := p.Discard("a", a, nil); err != ErrDoublePut {
+		t.Errorf("expected ErrDoublePut, got %v", err)
+	}
+
+	// the discarded connection no longer counts against the total
+	if _, err := p.GetWithTimeout("a", 100*time.Millisecond); err != nil {
+		t.Errorf("expected a connection once one is discarded, got %v", err)
+	}
+	if discarded := p.Stats().Discarded; discarded != 1 {
+		t.Errorf("expected 1 discarded connection, got %d", discarded)
+	}
+}
+
+func TestKeyedPool_SetKeyOptions(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.SetKeyOptions("big", Options[string]{MaxCap: 3}); err != nil {
+		t.Fatal(err)
+	}
+	p.Get("big")
+	if stats, _ := p.KeyStats("big"); stats.MaxOpen != 3 {
+		t.Errorf("expected the options of the key to apply, got MaxOpen %d", stats.MaxOpen)
+	}
+	if err := p.SetKeyOptions("big", Options[string]{MaxCap: 1}); err == nil {
+		t.Errorf("expected options of a key in use to be rejected")
+	}
+}
+
+func TestKeyedPool_Resize(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{InitialCap: 2, MaxCap: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.SetKeyOptions("big", Options[string]{MaxCap: 5})
+	p.Get("big")
+
+	conn, _ := p.Get("a")
+	p.Put("a", conn)
+	if err := p.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := p.KeyStats("a"); stats.MaxOpen != 1 || stats.Open != 1 {
+		t.Errorf("expected the pool of key a to shrink, got %+v", stats)
+	}
+	// pools created later get the new capacity as well
+	p.Get("b")
+	if stats, _ := p.KeyStats("b"); stats.MaxOpen != 1 {
+		t.Errorf("expected the pool of key b to be created with the new capacity, got %d", stats.MaxOpen)
+	}
+	// keys with options of their own keep their capacity
+	if stats, _ := p.KeyStats("big"); stats.MaxOpen != 5 {
+		t.Errorf("expected the pool of key big to keep its capacity, got %d", stats.MaxOpen)
+	}
+}
+
+func TestKeyedPool_MaxKeyIdleTime(t *testing.T) {
+	var closed int32
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{
+		Options: Options[string]{
+			MaxCap: 2,
+			CloseFunc: func(string) error {
+				atomic.AddInt32(&closed, 1)
+				return nil
+			},
+		},
+		MaxKeyIdleTime: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	idle, _ := p.Get("idle")
+	idle2, _ := p.Get("idle")
+	if _, err := p.GetWithTimeout("idle", time.Millisecond); err != ErrTimedOut {
+		t.Fatalf("expected ErrTimedOut, got %v", err)
+	}
+	p.Put("idle", idle)
+	p.Put("idle", idle2)
+	busy, _ := p.Get("busy")
+	if _, err := p.GetWithTimeout("busy", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := p.KeyStats("idle"); ok {
+		t.Errorf("expected the pool of the idle key to be closed")
+	}
+	if atomic.LoadInt32(&closed) != 2 {
+		t.Errorf("expected the connections of the idle key to be closed, %d were", closed)
+	}
+	if _, ok := p.KeyStats("busy"); !ok {
+		t.Errorf("expected the pool of a key with borrowed connections to be kept")
+	}
+	// counters of evicted keys are kept while their gauges are not
+	if stats := p.Stats(); stats.MaxOpen != 2 || stats.Timeouts != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// an evicted key gets a fresh pool
+	if err := p.Put("idle", idle); !errors.Is(err, ErrForeignConnection) {
+		t.Errorf("expected ErrForeignConnection, got %v", err)
+	}
+	conn, err := p.Get("idle")
+	if err != nil || conn.Conn != "idle" {
+		t.Errorf("expected a new connection, got %v", err)
+	}
+	p.Put("busy", busy)
+}
+
+func TestKeyedPool_Shutdown(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := p.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put("b", b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	leaked, err := p.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the shutdown to time out, got %v", err)
+	}
+	if len(leaked) != 1 || leaked[0] != a {
+		t.Errorf("expected the connection to shard a to be reported, got %v", leaked)
+	}
+	if _, err := p.Get("b"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	p.Put("a", a)
+	if leaked, err := p.Shutdown(context.Background()); err != nil || len(leaked) != 0 {
+		t.Errorf("expected a clean shutdown once put back, got %v, %v", leaked, err)
+	}
+}
+
+func TestKeyedPool_DebugDump(t *testing.T) {
+	p, err := NewKeyedPool(shardFactory, KeyedOptions[string]{Options: Options[string]{MaxCap: 1, LeakThreshold: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put("b", conn)
+
+	var dump bytes.Buffer
+	if err := p.DebugDump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "== a: 1 connections borrowed\n") ||
+		!strings.Contains(dump.String(), "== b: 0 connections borrowed\n") ||
+		!strings.Contains(dump.String(), "TestKeyedPool_DebugDump") {
+		t.Errorf("unexpected dump:\n%s", dump.String())
+	}
+}
@@ -0,0 +1,100 @@
+package typed
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// leakDetector reports the connections borrowed for longer than
+// LeakThreshold until the pool is closed.
+func (c *ChannelPool[T]) leakDetector() {
+	interval := c.leakThreshold / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			for _, l := range c.detectLeaks(now) {
+				if c.onLeak != nil {
+					c.onLeak(l.conn)
+				} else {
+					log.Printf("pool: connection borrowed for %s, possibly leaked by:\n%s",
+						now.Sub(l.borrowedAt), l.stack)
+				}
+			}
+		}
+	}
+}
+
+// leak is a connection to report as leaked along with when and where it
+// was borrowed, taken while holding mu.
+type leak[T any] struct {
+	conn       *Holder[T]
+	borrowedAt time.Time
+	stack      []byte
+}
+
+// detectLeaks returns the connections borrowed since before
+// now-LeakThreshold which were not reported yet, marking them as reported.
+func (c *ChannelPool[T]) detectLeaks(now time.Time) []leak[T] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var leaked []leak[T]
+	for conn := range c.borrowed {
+		if conn.leaked || now.Sub(conn.borrowedAt) < c.leakThreshold {
+			continue
+		}
+		conn.leaked = true
+		leaked = append(leaked, leak[T]{conn, conn.borrowedAt, conn.stack})
+	}
+	atomic.AddInt64(&c.stats.leaks, int64(len(leaked)))
+	return leaked
+}
+
+// DebugDump writes the connections currently borrowed to w, the longest
+// borrowed first, along with the stack traces of their borrowers if
+// LeakThreshold is set. Connections reported as leaked are flagged.
+func (c *ChannelPool[T]) DebugDump(w io.Writer) error {
+	c.mu.Lock()
+	type entry struct {
+		borrowedAt time.Time
+		stack      []byte
+		leaked     bool
+	}
+	entries := make([]entry, 0, len(c.borrowed))
+	for conn := range c.borrowed {
+		entries = append(entries, entry{conn.borrowedAt, conn.stack, conn.leaked})
+	}
+	c.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].borrowedAt.Before(entries[j].borrowedAt) })
+
+	now := time.Now()
+	if _, err := fmt.Fprintf(w, "%d connections borrowed\n", len(entries)); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		flag := ""
+		if e.leaked {
+			flag = " (leaked)"
+		}
+		stack := "stack not recorded, see Options.LeakThreshold\n"
+		if e.stack != nil {
+			stack = string(e.stack)
+		}
+		if _, err := fmt.Fprintf(w, "\nconnection borrowed for %s%s:\n%s", now.Sub(e.borrowedAt), flag, stack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
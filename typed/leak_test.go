@@ -0,0 +1,126 @@
+package typed
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool_LeakDetection(t *testing.T) {
+	leaks := make(chan *Holder[string], 10)
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		MaxCap:        2,
+		LeakThreshold: 10 * time.Millisecond,
+		OnLeak:        func(conn *Holder[string]) { leaks <- conn },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	leaked, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(returned)
+
+	select {
+	case conn := <-leaks:
+		if conn != leaked {
+			t.Errorf("expected the borrowed connection to be reported")
+		}
+		if !strings.Contains(conn.BorrowStack(), "TestPool_LeakDetection") {
+			t.Errorf("expected the stack of the borrower, got %s", conn.BorrowStack())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leak was not reported")
+	}
+
+	// a leak is reported once
+	time.Sleep(30 * time.Millisecond)
+	if len(leaks) != 0 {
+		t.Errorf("expected the leak to be reported once, got %d more", len(leaks))
+	}
+	if stats := p.Stats(); stats.Leaks != 1 {
+		t.Errorf("expected 1 leak, got %d", stats.Leaks)
+	}
+
+	var dump bytes.Buffer
+	if err := p.DebugDump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dump.String(), "1 connections borrowed\n") ||
+		!strings.Contains(dump.String(), "(leaked)") ||
+		!strings.Contains(dump.String(), "TestPool_LeakDetection") {
+		t.Errorf("unexpected dump:\n%s", dump.String())
+	}
+}
+
+func TestPool_DebugDump_NoStacks(t *testing.T) {
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{MaxCap: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.BorrowStack() != "" {
+		t.Errorf("expected no stack to be recorded, got %s", conn.BorrowStack())
+	}
+
+	var dump bytes.Buffer
+	if err := p.DebugDump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "stack not recorded") {
+		t.Errorf("unexpected dump:\n%s", dump.String())
+	}
+}
+
+// TestPool_LeakDetection_Reborrow reports leaks while the connections are
+// put back and borrowed again, and is meant to be run with -race.
+func TestPool_LeakDetection_Reborrow(t *testing.T) {
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		MaxCap:        2,
+		LeakThreshold: time.Millisecond,
+		OnLeak: func(conn *Holder[string]) {
+			_ = conn.BorrowedAt()
+			_ = conn.BorrowStack()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				conn, err := p.Get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(2 * time.Millisecond)
+				p.Put(conn)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p.Stats().Leaks == 0 {
+		t.Errorf("expected leaks to be reported")
+	}
+}
@@ -0,0 +1,206 @@
+// Package typed implements a type-safe pool of connections of any type T to
+// manage and reuse them. Package pool offers the same pool for interface{}
+// connections on top of it.
+package typed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrClosed is the error resulting if the pool is closed via pool.Close().
+	ErrClosed = errors.New("pool is closed")
+	// ErrTimedOut is the error resulting if no connection became available
+	// in time. Errors returned by GetContext wrap it along with ctx.Err().
+	ErrTimedOut = errors.New("timed out waiting for connection")
+	// ErrDoublePut is the error resulting if a connection is put back to the
+	// pool while it is not borrowed, e.g. when it was already put back.
+	ErrDoublePut = errors.New("connection is not borrowed from the pool")
+	// ErrForeignConnection is the error resulting if a connection is put back
+	// to a pool other than the one it was borrowed from.
+	ErrForeignConnection = errors.New("connection does not belong to the pool")
+)
+
+// Holder wraps a connection handed out by a pool and tracks which pool owns
+// it and whether it is currently borrowed. Every Get hands out a new holder,
+// so a holder which was put back stays released even once its connection is
+// borrowed again, and putting it back again fails with ErrDoublePut.
+type Holder[T any] struct {
+	Conn T
+
+	// owner is the pool which created the holder, it is nil for holders
+	// created through NewHolder which no pool accepts
+	owner *ChannelPool[T]
+	// inUse is 1 while the holder is borrowed, accessed atomically
+	inUse int32
+	// createdAt is when the connection was created by the pool
+	createdAt time.Time
+	// lastUsed is when the holder was last put back to the pool
+	lastUsed time.Time
+
+	// borrowedAt and stack tell when and where the holder was borrowed,
+	// stack being recorded only if leaks are detected. They are set before
+	// the holder is handed out and never change, every Get handing out a
+	// new holder.
+	borrowedAt time.Time
+	stack      []byte
+	// leaked tells whether the holder was reported as leaked, guarded by
+	// the mutex of the owner
+	leaked bool
+}
+
+// NewHolder wraps conn in a holder which does not belong to any pool.
+func NewHolder[T any](conn T) *Holder[T] {
+	return &Holder[T]{Conn: conn}
+}
+
+// InUse reports whether the connection is currently borrowed from its pool.
+func (h *Holder[T]) InUse() bool {
+	return atomic.LoadInt32(&h.inUse) == 1
+}
+
+// CreatedAt returns when the pool created the connection.
+func (h *Holder[T]) CreatedAt() time.Time {
+	return h.createdAt
+}
+
+// LastUsed returns when the connection was last put back to the pool, or when
+// it was created if it has never been put back.
+func (h *Holder[T]) LastUsed() time.Time {
+	return h.lastUsed
+}
+
+// BorrowedAt returns when the connection was borrowed through the holder.
+func (h *Holder[T]) BorrowedAt() time.Time {
+	return h.borrowedAt
+}
+
+// BorrowStack returns the stack trace of the goroutine which borrowed the
+// connection through the holder, if recorded, see Options.LeakThreshold.
+func (h *Holder[T]) BorrowStack() string {
+	return string(h.stack)
+}
+
+// release marks the holder as returned, it reports false if the holder was
+// not borrowed.
+func (h *Holder[T]) release() bool {
+	return atomic.CompareAndSwapInt32(&h.inUse, 1, 0)
+}
+
+// Pool interface describes a pool implementation. A pool should have maximum
+// capacity. An ideal pool is threadsafe and easy to use.
+type Pool[T any] interface {
+	// Get returns a new connection from the pool. Closing the connections puts
+	// it back to the Pool. Closing it when the pool is destroyed or full will
+	// be counted as an error.
+	Get() (*Holder[T], error)
+
+	GetWithTimeout(time.Duration) (*Holder[T], error)
+
+	// GetContext is like Get but stops waiting once ctx is done.
+	GetContext(ctx context.Context) (*Holder[T], error)
+
+	// GetWithPriority is like GetContext but waits with priority. Available
+	// connections go to the waiter with the highest priority first.
+	GetWithPriority(ctx context.Context, priority Priority) (*Holder[T], error)
+
+	// Put returns a borrowed connection to the pool. It fails with
+	// ErrDoublePut if the connection is not borrowed and with
+	// ErrForeignConnection if it was not borrowed from this pool.
+	Put(*Holder[T]) error
+	// Discard closes a borrowed connection which is broken instead of
+	// putting it back, and creates a replacement in the background.
+	Discard(conn *Holder[T], reason error) error
+	// Resize changes the maximum number of open connections of the pool.
+	Resize(maxCap int) error
+
+	// Close closes the pool and all its connections. After Close() the pool is
+	// no longer usable. Borrowed connections are closed when they are put back.
+	Close() error
+
+	// Shutdown closes the pool and waits until the borrowed connections are
+	// put back and closed. If ctx is done first, it returns ctx.Err() along
+	// with the connections still borrowed.
+	Shutdown(ctx context.Context) ([]*Holder[T], error)
+
+	// DebugDump writes the connections currently borrowed to w, along with
+	// the stack traces of their borrowers if recorded.
+	DebugDump(w io.Writer) error
+
+	// Len returns the current number of connections of the pool.
+	Len() int
+
+	// Stats returns a snapshot of the pool statistics.
+	Stats() Stats
+}
+
+// Stats contains pool statistics, much like sql.DBStats does for a sql.DB.
+type Stats struct {
+	MaxOpen int // Maximum number of open connections.
+
+	// Pool status
+	Open  int // Number of open connections, idle, in use or being dialed.
+	Idle  int // Number of idle connections.
+	InUse int // Number of connections currently borrowed.
+
+	WaitQueue int // Number of Get calls currently queued waiting for a connection.
+
+	// Counters
+	WaitCount     int64         // Total number of Get calls which had to wait for a connection.
+	WaitDuration  time.Duration // Total time spent waiting for a connection.
+	Timeouts      int64         // Total number of waits given up because the context was done.
+	FactoryErrors int64         // Total number of failed attempts to create a connection.
+
+	IdleClosed        int64 // Total number of connections closed due to MaxIdleTime.
+	LifetimeClosed    int64 // Total number of connections closed due to MaxLifetime.
+	HealthCheckClosed int64 // Total number of connections closed due to a failed health check.
+	Discarded         int64 // Total number of connections closed through Discard.
+
+	Leaks int64 // Total number of connections reported as leaked, see Options.LeakThreshold.
+
+	// WaitHistogram counts the waits accounted in WaitCount by duration. The
+	// count at index i is for waits up to WaitBuckets[i] which were longer
+	// than the previous bound, the last one is for waits beyond all bounds.
+	WaitHistogram [len(WaitBuckets) + 1]int64
+}
+
+// add adds the statistics of another pool to s.
+func (s *Stats) add(o Stats) {
+	s.MaxOpen += o.MaxOpen
+	s.Open += o.Open
+	s.Idle += o.Idle
+	s.InUse += o.InUse
+	s.WaitQueue += o.WaitQueue
+	s.WaitCount += o.WaitCount
+	s.WaitDuration += o.WaitDuration
+	s.Timeouts += o.Timeouts
+	s.FactoryErrors += o.FactoryErrors
+	s.IdleClosed += o.IdleClosed
+	s.LifetimeClosed += o.LifetimeClosed
+	s.HealthCheckClosed += o.HealthCheckClosed
+	s.Discarded += o.Discarded
+	s.Leaks += o.Leaks
+	for i := range s.WaitHistogram {
+		s.WaitHistogram[i] += o.WaitHistogram[i]
+	}
+}
+
+// WaitBuckets are the upper bounds of the buckets of Stats.WaitHistogram.
+var WaitBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
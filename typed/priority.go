@@ -0,0 +1,70 @@
+package typed
+
+import (
+	"context"
+	"sort"
+)
+
+// Priority orders the callers waiting for a connection, a connection which
+// becomes available goes to the waiter with the highest priority first and
+// to the one waiting the longest among equals.
+type Priority int
+
+const (
+	// PriorityLow is meant for background work such as batch jobs.
+	PriorityLow Priority = -1
+	// PriorityNormal is the priority of callers which don't set one.
+	PriorityNormal Priority = 0
+	// PriorityHigh is meant for latency sensitive work such as serving
+	// interactive requests.
+	PriorityHigh Priority = 1
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying priority, GetContext and the
+// requests of adapters.PooledHttpClient made with it wait for a connection
+// with that priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority carried by ctx, PriorityNormal if
+// there is none.
+func PriorityFromContext(ctx context.Context) Priority {
+	priority, _ := ctx.Value(priorityKey{}).(Priority)
+	return priority
+}
+
+// reservation is a number of connections kept for callers of at least a
+// priority, see Options.Reserved.
+type reservation struct {
+	priority Priority
+	n        int
+}
+
+// makeReservations returns the reservations of reserved, highest priority
+// first.
+func makeReservations(reserved map[Priority]int) []reservation {
+	reservations := make([]reservation, 0, len(reserved))
+	for priority, n := range reserved {
+		if n > 0 {
+			reservations = append(reservations, reservation{priority, n})
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].priority > reservations[j].priority })
+	return reservations
+}
+
+// reservedAbove returns the number of connections kept for callers of a
+// higher priority than priority.
+func reservedAbove(reservations []reservation, priority Priority) int {
+	n := 0
+	for _, r := range reservations {
+		if r.priority <= priority {
+			break
+		}
+		n += r.n
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+package typed
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestPriorityFromContext(t *testing.T) {
+	if p := PriorityFromContext(context.Background()); p != PriorityNormal {
+		t.Errorf("expected PriorityNormal, got %d", p)
+	}
+	ctx := WithPriority(context.Background(), PriorityHigh)
+	if p := PriorityFromContext(ctx); p != PriorityHigh {
+		t.Errorf("expected PriorityHigh, got %d", p)
+	}
+}
+
+func TestPool_PriorityWaiters(t *testing.T) {
+	p, err := NewChannelPool(1, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, _ := p.Get()
+	served := make(chan Priority, 3)
+	for i, priority := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		go func(priority Priority) {
+			var conn *Holder[string]
+			if priority == PriorityHigh {
+				conn, _ = p.GetContext(WithPriority(context.Background(), priority))
+			} else {
+				conn, _ = p.GetWithPriority(context.Background(), priority)
+			}
+			served <- priority
+			p.Put(conn)
+		}(priority)
+		waitForQueue(t, p, i+1)
+	}
+
+	p.Put(conn)
+	for _, want := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		if got := <-served; got != want {
+			t.Errorf("expected priority %d to be served, got %d", want, got)
+		}
+	}
+}
+
+func TestPool_Reserved(t *testing.T) {
+	p, err := NewChannelPoolWithOptions(factory, Options[string]{
+		MaxCap:   3,
+		Reserved: map[Priority]int{PriorityHigh: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	low := context.Background()
+	conn1, _ := p.GetWithPriority(low, PriorityLow)
+	p.GetWithPriority(low, PriorityNormal)
+
+	// the last connection is kept for high priority callers
+	ctx, cancel := context.WithTimeout(low, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetWithPriority(ctx, PriorityNormal); err == nil {
+		t.Fatalf("expected the reserved connection to be kept")
+	}
+	high, err := p.GetWithPriority(low, PriorityHigh)
+	if err != nil {
+		t.Fatalf("expected the reserved connection for a high priority caller, got %v", err)
+	}
+
+	// once one is put back, a lower priority waiter may have it unless it is
+	// the last one available
+	served := make(chan *Holder[string])
+	go func() {
+		conn, _ := p.GetWithPriority(low, PriorityLow)
+		served <- conn
+	}()
+	waitForQueue(t, p, 1)
+	p.Put(high)
+	select {
+	case <-served:
+		t.Fatalf("expected the reserved connection to be kept")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.Put(conn1)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the low priority waiter to be served")
+	}
+
+	if _, err := NewChannelPoolWithOptions(factory, Options[string]{MaxCap: 1, Reserved: map[Priority]int{PriorityHigh: 2}}); err == nil {
+		t.Errorf("expected reserving more than MaxCap to be rejected")
+	}
+}
@@ -0,0 +1,72 @@
+package typed
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// DialRetryPolicy retries failed attempts to create a connection, waiting
+// exponentially longer between the attempts.
+type DialRetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Zero or one means no retries.
+	MaxAttempts int
+	// BaseDelay, MaxDelay and Jitter shape the delays between the attempts,
+	// see Backoff.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Jitter    float64
+}
+
+// valid reports whether the policy settings make sense.
+func (p DialRetryPolicy) valid() bool {
+	return p.MaxAttempts >= 0 && p.BaseDelay >= 0 && p.MaxDelay >= 0 && p.Jitter >= 0 && p.Jitter <= 1
+}
+
+// Backoff returns the delay to wait after attempt, counting from 1, before
+// the next one. The delay is base after the first attempt and doubles for
+// every attempt after that, capped at maxDelay unless it is zero. Jitter is
+// the fraction, between 0 and 1, by which the delay is randomly shortened
+// so that clients don't retry in lockstep.
+func Backoff(attempt int, base, maxDelay time.Duration, jitter float64) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if maxDelay > 0 && delay >= maxDelay {
+			break
+		}
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	if jitter > 0 {
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+	return delay
+}
+
+// dialWithRetry is like dial but retries failed attempts as configured by
+// Options.DialRetry. It gives up with the last factory error once the
+// attempts are exhausted, and right away when ctx is done or the pool is
+// closed.
+func (c *ChannelPool[T]) dialWithRetry(ctx context.Context) (*Holder[T], error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dial(ctx)
+		if err == nil || err == ErrClosed || attempt >= c.dialRetry.MaxAttempts || ctx.Err() != nil {
+			return conn, err
+		}
+
+		p := c.dialRetry
+		timer := time.NewTimer(Backoff(attempt, p.BaseDelay, p.MaxDelay, p.Jitter))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-c.closing.Done():
+			timer.Stop()
+			return nil, ErrClosed
+		}
+	}
+}
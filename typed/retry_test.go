@@ -0,0 +1,24 @@
+package typed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := Backoff(attempt+1, 10*time.Millisecond, 50*time.Millisecond, 0); got != want*time.Millisecond {
+			t.Errorf("attempt %d: expected %s, got %s", attempt+1, want*time.Millisecond, got)
+		}
+	}
+
+	for attempt := 1; attempt < 100; attempt++ {
+		got := Backoff(attempt, 10*time.Millisecond, 50*time.Millisecond, 0.5)
+		if got <= 0 || got > 50*time.Millisecond {
+			t.Fatalf("attempt %d: jittered delay %s out of range", attempt, got)
+		}
+		if attempt == 1 && got < 5*time.Millisecond {
+			t.Fatalf("jittered delay %s shortened by more than the jitter", got)
+		}
+	}
+}